@@ -0,0 +1,128 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/protocol"
+)
+
+var (
+	calibrate       = flag.Duration("calibrate", 0, "average the frequency offset of messages for this long and recommend a -freqcorrection, use -filterid to select known meters")
+	calibrateFreq   = flag.Uint("calibratefreq", 0, "carrier frequency of meters used for calibration, 0 for each message type's nominal frequency")
+	applyCorrection = flag.Bool("applycorrection", false, "apply the recommended frequency correction to rtl_tcp once calibration finishes")
+)
+
+// A Calibration averages the frequency error of messages decoded by a
+// receiver over a period and recommends a frequency correction for its
+// dongle. Methods must be called from a single goroutine.
+type Calibration struct {
+	name       string
+	centerFreq uint32
+	correction int
+	deadline   time.Time
+
+	// Nominal carrier frequency of each message type.
+	carriers map[string]uint32
+
+	count int
+	sum   float64 // Frequency error in ppm.
+	done  bool
+}
+
+// Make a new calibration for a receiver tuned to centerFreq with the given
+// frequency correction in ppm, finishing after the -calibrate period.
+func NewCalibration(name string, centerFreq uint32, correction int) *Calibration {
+	return &Calibration{
+		name:       name,
+		centerFreq: centerFreq,
+		correction: correction,
+		deadline:   time.Now().Add(*calibrate),
+		carriers:   map[string]uint32{},
+	}
+}
+
+// Returns the frequency a message's meter is expected to transmit on.
+func (cal *Calibration) carrier(msgType string) uint32 {
+	if *calibrateFreq != 0 {
+		return uint32(*calibrateFreq)
+	}
+
+	name := strings.ToLower(msgType)
+	if freq, ok := cal.carriers[name]; ok {
+		return freq
+	}
+
+	var freq uint32
+	if p, err := protocol.NewParser(name, *symbolLength); err == nil {
+		freq = p.Cfg().CenterFreq
+	}
+	cal.carriers[name] = freq
+
+	return freq
+}
+
+// Add a message's frequency error to the average.
+func (cal *Calibration) Add(msg protocol.LogMessage) {
+	if cal.done {
+		return
+	}
+
+	carrier := cal.carrier(msg.Type)
+	if carrier == 0 {
+		return
+	}
+
+	// The dongle's oscillator runs fast by the error, so carriers appear
+	// below where they should.
+	expected := float64(carrier) - float64(cal.centerFreq)
+	errHz := expected - msg.FreqOffset
+	cal.sum += errHz / float64(cal.centerFreq) * 1e6
+	cal.count++
+}
+
+// Once the calibration period is over, logs the measured error and returns
+// the recommended frequency correction in ppm. Reports false until then, or
+// if no messages were heard.
+func (cal *Calibration) Finish(now time.Time) (correction int, ok bool) {
+	if cal.done || now.Before(cal.deadline) {
+		return 0, false
+	}
+	cal.done = true
+
+	if cal.count == 0 {
+		slog.Warn("calibration heard no messages", "name", cal.name)
+		return 0, false
+	}
+
+	ppm := cal.sum / float64(cal.count)
+	correction = cal.correction + int(math.Round(ppm))
+
+	slog.Info("calibration",
+		"name", cal.name,
+		"messages", cal.count,
+		"error_ppm", math.Round(ppm*100)/100,
+		"freqcorrection", correction,
+	)
+
+	return correction, true
+}
@@ -0,0 +1,143 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command rtlamr-sim is an rtl_tcp server which synthesizes meter traffic
+// instead of receiving it, for testing rtlamr without a dongle.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/sim"
+)
+
+var (
+	listen     = flag.String("listen", "127.0.0.1:1234", "address to listen for rtl_tcp clients on")
+	msgType    = flag.String("msgtype", "scm,scm+,idm,netidm,r900", "comma-separated list of message types to transmit")
+	snr        = flag.Float64("snr", 20, "signal to noise ratio of each packet in dB")
+	freqOffset = flag.Float64("freqoffset", 0, "carrier frequency offset of each packet in Hz")
+	ppm        = flag.Float64("ppm", 0, "error of the simulated dongle's oscillator in ppm, offset by -freqcorrection from the client")
+	clockPPM   = flag.Float64("clockppm", 0, "error of each meter's chip clock in ppm")
+	hop        = flag.Int("hop", 1, "number of channels meters hop between, centered on each protocol's carrier")
+	impulses   = flag.Float64("impulses", 0, "impulses per second, such as switching power supplies emit")
+	interferer = flag.Float64("interferer", 0, "offset in Hz from the center frequency of a continuous carrier interfering with packets, 0 for none")
+	intLevel   = flag.Float64("interfererlevel", 10, "power of the interfering carrier in dB relative to the noise")
+	dc         = flag.Float64("dc", 0, "power in dB relative to the noise of a DC offset added to samples, 0 for none")
+	collisions = flag.Float64("collisions", 0, "fraction of packets a neighbouring meter's packet overlaps")
+	collLevel  = flag.Float64("collisionlevel", -6, "power of a neighbouring meter's packet in dB relative to the packet it overlaps")
+	interval   = flag.Duration("interval", 250*time.Millisecond, "time between packets")
+	symbolLen  = flag.Int("symbollength", 72, "symbol length in samples, sets the initial sample rate")
+	sampleRate = flag.Int("samplerate", 0, "initial sample rate in Hz, overrides -symbollength")
+	centerFreq = flag.Uint("centerfreq", 912600155, "initial center frequency in Hz")
+	realtime   = flag.Bool("realtime", true, "pace samples at the sample rate")
+	seed       = flag.Int64("seed", 1, "random number generator seed")
+	output     = flag.String("output", "", "write -duration of samples to a file, - for stdout, instead of listening")
+	duration   = flag.Duration("duration", 10*time.Second, "duration of samples to write with -output")
+)
+
+// One meter per message type.
+var meters = map[string]sim.Meter{
+	"scm":    {Protocol: "scm", ID: 12345678, Type: 12, Consumption: 1000},
+	"scm+":   {Protocol: "scm+", ID: 23456789, Type: 7, Consumption: 2000},
+	"idm":    {Protocol: "idm", ID: 34567890, Type: 8, Consumption: 3000},
+	"netidm": {Protocol: "netidm", ID: 45678901, Type: 8, Consumption: 4000},
+	"r900":   {Protocol: "r900", ID: 1234567890, Type: 0, Consumption: 5000},
+}
+
+func main() {
+	flag.Parse()
+
+	var m []sim.Meter
+	for _, name := range strings.Split(*msgType, ",") {
+		meter, ok := meters[strings.TrimSpace(name)]
+		if !ok {
+			log.Fatalf("invalid message type: %q", name)
+		}
+		m = append(m, meter)
+	}
+
+	rate := sim.ChipRate * *symbolLen
+	if *sampleRate != 0 {
+		rate = *sampleRate
+	}
+
+	srv := sim.Server{
+		Config: sim.Config{
+			SampleRate: rate,
+			CenterFreq: uint32(*centerFreq),
+			SNR:        *snr,
+			FreqOffset: *freqOffset,
+			PPM:        *ppm,
+			ClockPPM:   *clockPPM,
+			Hop:        *hop,
+			Impulses:   *impulses,
+			Interval:   *interval,
+			Seed:       *seed,
+
+			Interferer:      *interferer,
+			InterfererLevel: *intLevel,
+			DC:              *dc,
+
+			Collisions:     *collisions,
+			CollisionLevel: *collLevel,
+		},
+		Meters:   m,
+		Realtime: *realtime,
+	}
+
+	if *output != "" {
+		if err := writeSamples(srv.Config, m); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s", l.Addr())
+
+	log.Fatal(srv.Serve(l))
+}
+
+// Writes -duration of samples to -output.
+func writeSamples(cfg sim.Config, m []sim.Meter) error {
+	g, err := sim.NewGenerator(cfg, m)
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	n := int64(duration.Seconds()*float64(cfg.SampleRate)) << 1
+	_, err = io.CopyN(w, g, n)
+	return err
+}
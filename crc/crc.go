@@ -29,6 +29,85 @@ func (crc CRC) Checksum(data []byte) uint16 {
 	return Checksum(crc.Init, data, crc.tbl)
 }
 
+// Syndrome of a message which includes its checksum, zero if the message is
+// intact. The syndrome depends only on which bits are in error, not on the
+// message.
+func (crc CRC) Syndrome(data []byte) uint16 {
+	return crc.Checksum(data) ^ crc.Residue
+}
+
+// Syndromes maps the syndrome of each correctable error pattern to the bit
+// positions in error, most significant bit of the first byte first.
+type Syndromes map[uint16][]int
+
+// Returns the syndrome of an error in each bit of a message of n bytes,
+// including its checksum. Checksums are linear, the syndrome of several
+// errors is the sum of the syndromes of each.
+func (crc CRC) BitSyndromes(n int) []uint16 {
+	syndromes := make([]uint16, n<<3)
+	buf := make([]byte, n)
+	for bIdx := range syndromes {
+		buf[bIdx>>3] = 0x80 >> uint(bIdx&7)
+		syndromes[bIdx] = Checksum(0, buf, crc.tbl)
+		buf[bIdx>>3] = 0
+	}
+	return syndromes
+}
+
+// Make a table of syndromes of every error pattern of up to maxErrors bits in
+// a message of n bytes, including its checksum. Bits before first are known,
+// such as those of a preamble, and never in error. Patterns sharing a
+// syndrome with another pattern can't be told apart and are left out.
+func (crc CRC) Syndromes(n, first, maxErrors int) Syndromes {
+	single := crc.BitSyndromes(n)
+
+	table := make(Syndromes)
+	ambiguous := map[uint16]bool{0: true}
+
+	var add func(start int, syndrome uint16, bits []int)
+	add = func(start int, syndrome uint16, bits []int) {
+		if len(bits) > 0 {
+			if _, dup := table[syndrome]; dup || ambiguous[syndrome] {
+				delete(table, syndrome)
+				ambiguous[syndrome] = true
+			} else {
+				table[syndrome] = append([]int(nil), bits...)
+			}
+		}
+		if len(bits) == maxErrors {
+			return
+		}
+		for bIdx := start; bIdx < len(single); bIdx++ {
+			add(bIdx+1, syndrome^single[bIdx], append(bits, bIdx))
+		}
+	}
+	add(first, 0, nil)
+
+	return table
+}
+
+// Correct the bits of data in error according to its syndrome. Returns the
+// number of bits corrected, or -1 if the errors can't be corrected. If data
+// is nil, only the number of bits in error is returned.
+func (s Syndromes) Correct(data []byte, syndrome uint16) int {
+	if syndrome == 0 {
+		return 0
+	}
+
+	bits, ok := s[syndrome]
+	if !ok {
+		return -1
+	}
+
+	if data != nil {
+		for _, bIdx := range bits {
+			data[bIdx>>3] ^= 0x80 >> uint(bIdx&7)
+		}
+	}
+
+	return len(bits)
+}
+
 type Table [256]uint16
 
 func NewTable(poly uint16) (table Table) {
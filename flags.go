@@ -28,19 +28,77 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bemasher/rtlamr/csv"
 	"github.com/bemasher/rtlamr/protocol"
+	"github.com/bemasher/rtlamr/r900"
+	"github.com/bemasher/rtlamr/scm"
 )
 
 var (
 	sampleFile   = flag.String("samplefile", os.DevNull, "raw signal dump file")
 	sampleWriter = io.Discard
+	sampleMeta   *SigMF
+)
+
+var (
+	source    = flag.String("source", "rtltcp", "sample source: rtltcp, tcp (raw samples from -server), stdin or file")
+	inputFile = flag.String("inputfile", "", "decode raw samples from file instead of rtl_tcp")
+	realTime  = flag.Bool("realtime", false, "pace sample reads at the configured sample rate")
+
+	sampleFormat = flag.String("sampleformat", "cu8", "format of input samples: cu8, cs8, cs16 or cf32")
+)
+
+var dedupWindow = flag.Duration("dedupwindow", time.Second, "with several servers, merge identical messages heard within this window")
+
+// A named rtl_tcp server given by -server, e.g. "a=host1:1234,b=host2:1234".
+type Server struct {
+	Name string
+	Addr string
+}
+
+var servers []Server
+
+var (
+	reconnect  = flag.Bool("reconnect", false, "reconnect to rtltcp and tcp sources with exponential backoff after read errors, instead of exiting")
+	maxBackoff = flag.Duration("maxbackoff", time.Minute, "maximum delay between reconnection attempts")
 )
 
 var msgType StringMap
 
-var symbolLength = flag.Int("symbollength", 72, "symbol length in samples (8, 32, 40, 48, 56, 64, 72, 80, 88, 96)")
+var (
+	scmCorrect  = flag.Int("scmcorrect", 0, "correct up to this many bit errors in scm packets: 0, 1 or 2, more corrections accept more corrupt packets")
+	r900Correct = flag.Int("r900correct", 0, "correct up to this many symbol errors in r900 and r900bcd packets: 0, 1 or 2, more corrections accept more corrupt packets")
+)
+
+var (
+	maxFlips  = flag.Int("maxflips", 0, "recover scm+, idm and netidm packets failing their checksum by flipping up to this many of their least confident bits, 0 disables")
+	flipLimit = flag.Int("fliplimit", protocol.FlipLimit, "maximum bit flip patterns tried per packet, each pattern tried accepts a corrupt packet with probability 2^-16")
+)
+
+var timingRecovery = flag.Bool("timingrecovery", false, "track symbol timing across each packet, recovers long packets from meters whose clock drifts from the nominal data rate")
+
+var iqCorrection = flag.Bool("iqcorrection", false, "continuously estimate and remove the DC offset and IQ imbalance of samples, improves sensitivity with dongles whose DC spike or mismatched I and Q are strong")
+
+var (
+	blanker    = flag.Float64("blanker", 0, "impulse blanking threshold in dB above the noise floor, 0 disables")
+	energyGate = flag.Bool("energygate", false, "skip searching for preambles in noise")
+)
+
+var sic = flag.Bool("sic", false, "recover packets colliding with decoded ones, except r900 and r900bcd")
+
+var preambleThreshold = flag.Float64("preamblethreshold", 0, "minimum normalized preamble correlation, 0 to 1, 0 requires an exact match")
+
+var channels = flag.Int("channels", 0, "number of ERT hop channels to decode at once, 0 decodes only the center frequency")
+
+var symbolLength = flag.Int("symbollength", 72, "symbol length in samples (8, 32, 40, 48, 56, 64, 72, 80, 88, 96), any from 8 to 96 when resampling")
+
+var captureRate = flag.Int("capturerate", 0, "sample rate in Hz to capture at, such as 2048000 or 2400000, resampled to the rate -symbollength sets for decoding, 0 captures at that rate, defaults to -samplerate if given")
+
+var bandwidth = flag.Float64("bandwidth", 0, "low pass filter bandwidth in Hz, 0 filters only what resampling must")
+
+var tuneOffset = flag.Int("tuneoffset", 0, "tune this many Hz above the center frequency, mixing samples back digitally")
 
 var (
 	timeLimit = flag.Duration("duration", 0, "time to run for, 0 for infinite, ex. 1h5m10s")
@@ -48,6 +106,11 @@ var (
 	meterType MeterTypeFilter
 )
 
+var (
+	minRSSI = flag.Float64("minrssi", -120, "display only messages with an RSSI of at least this many dBFS")
+	minSNR  = flag.Float64("minsnr", 0, "display only messages with an SNR of at least this many dB")
+)
+
 var _ = flag.Bool("unique", false, "suppress duplicate messages from each meter")
 
 var (
@@ -70,17 +133,46 @@ func RegisterFlags() {
 	flag.Var(meterType, "filtertype", "display only messages matching a type in a comma-separated list of types.")
 
 	rtlamrFlags := map[string]bool{
-		"samplefile":   true,
-		"msgtype":      true,
-		"symbollength": true,
-		"duration":     true,
-		"filterid":     true,
-		"filtertype":   true,
-		"format":       true,
-		"unique":       true,
-		"single":       true,
-		"cpuprofile":   true,
-		"version":      true,
+		"samplefile":        true,
+		"source":            true,
+		"inputfile":         true,
+		"realtime":          true,
+		"sampleformat":      true,
+		"reconnect":         true,
+		"maxbackoff":        true,
+		"dedupwindow":       true,
+		"msgtype":           true,
+		"symbollength":      true,
+		"capturerate":       true,
+		"bandwidth":         true,
+		"tuneoffset":        true,
+		"duration":          true,
+		"filterid":          true,
+		"filtertype":        true,
+		"minrssi":           true,
+		"minsnr":            true,
+		"calibrate":         true,
+		"calibratefreq":     true,
+		"applycorrection":   true,
+		"scan":              true,
+		"dwell":             true,
+		"timeslice":         true,
+		"channels":          true,
+		"preamblethreshold": true,
+		"timingrecovery":    true,
+		"iqcorrection":      true,
+		"blanker":           true,
+		"energygate":        true,
+		"sic":               true,
+		"scmcorrect":        true,
+		"r900correct":       true,
+		"maxflips":          true,
+		"fliplimit":         true,
+		"format":            true,
+		"unique":            true,
+		"single":            true,
+		"cpuprofile":        true,
+		"version":           true,
 	}
 
 	printDefaults := func(validFlags map[string]bool, inclusion bool) {
@@ -124,11 +216,126 @@ func EnvOverride() {
 func HandleFlags() {
 	var err error
 
+	// Resampled symbol lengths needn't give a sample rate the tuner supports.
+	resampling := *captureRate != 0
+	flag.Visit(func(f *flag.Flag) {
+		resampling = resampling || f.Name == "samplerate"
+	})
+
 	switch *symbolLength {
 	case 8, 32, 40, 48, 56, 64, 72, 80, 88, 96:
 		break
 	default:
-		log.Fatal("invalid symbollength")
+		if !resampling || *symbolLength < 8 || *symbolLength > 96 {
+			log.Fatal("invalid symbollength")
+		}
+	}
+
+	if *captureRate < 0 {
+		log.Fatal("invalid capturerate: ", *captureRate)
+	}
+
+	if *bandwidth < 0 {
+		log.Fatal("invalid bandwidth: ", *bandwidth)
+	}
+	if *bandwidth != 0 && *channels != 0 {
+		log.Fatal("-bandwidth can't be used with -channels, each channel is filtered to its own")
+	}
+
+	if *channels < 0 {
+		log.Fatal("invalid channels: ", *channels)
+	}
+
+	if *blanker < 0 {
+		log.Fatal("invalid blanker: ", *blanker)
+	}
+
+	if *preambleThreshold < 0 || *preambleThreshold > 1 {
+		log.Fatal("invalid preamblethreshold: ", *preambleThreshold)
+	}
+
+	if *scmCorrect < 0 || *scmCorrect > 2 {
+		log.Fatal("invalid scmcorrect: ", *scmCorrect)
+	}
+	scm.MaxCorrection = *scmCorrect
+
+	if *r900Correct < 0 || *r900Correct > 2 {
+		log.Fatal("invalid r900correct: ", *r900Correct)
+	}
+	r900.MaxCorrection = *r900Correct
+
+	if *maxFlips < 0 || *flipLimit < 1 {
+		log.Fatal("invalid maxflips or fliplimit")
+	}
+	protocol.MaxFlips, protocol.FlipLimit = *maxFlips, *flipLimit
+
+	// An input file implies the file source unless told otherwise.
+	sourceSet := false
+	flag.Visit(func(f *flag.Flag) {
+		sourceSet = sourceSet || f.Name == "source"
+	})
+	if *inputFile != "" && !sourceSet {
+		*source = "file"
+	}
+
+	switch *source {
+	case "rtltcp", "tcp", "stdin":
+		break
+	case "file":
+		if *inputFile == "" {
+			log.Fatal("file source requires -inputfile")
+		}
+	default:
+		log.Fatal("invalid source: ", *source)
+	}
+
+	if *timeSlice < 0 {
+		log.Fatal("invalid timeslice: ", *timeSlice)
+	}
+	if *timeSlice != 0 && (*scan != "" || *calibrate != 0) {
+		log.Fatal("-timeslice can't be used with -scan or -calibrate")
+	}
+	if *timeSlice != 0 && *source != "rtltcp" {
+		log.Fatal("-timeslice requires the rtltcp source, others can't be tuned")
+	}
+
+	if *scan != "" {
+		scanFreqs, err = ParseScan(*scan)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *calibrate != 0 {
+			log.Fatal("-calibrate measures a single center frequency and can't be used with -scan")
+		}
+		if *dwell <= 0 {
+			log.Fatal("invalid dwell: ", *dwell)
+		}
+		if *source != "rtltcp" {
+			log.Fatal("-scan requires the rtltcp source, others can't be tuned")
+		}
+	}
+
+	servers, err = ParseServers(rcvr.Flags.ServerAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(servers) == 1 {
+		rcvr.Flags.ServerAddr = servers[0].Addr
+	} else {
+		if !isNetworkSource(*source) {
+			log.Fatal("several servers require the rtltcp or tcp source")
+		}
+		if *sampleFile != os.DevNull {
+			log.Fatal("-samplefile is not supported with several servers")
+		}
+	}
+
+	*sampleFormat = strings.ToLower(*sampleFormat)
+	if _, err := protocol.NewDemodulator(*sampleFormat); err != nil {
+		log.Fatal(err)
+	}
+	if *source == "rtltcp" && *sampleFormat != "cu8" {
+		log.Fatal("rtl_tcp only provides cu8 samples")
 	}
 
 	if *sampleFile != os.DevNull {
@@ -136,6 +343,7 @@ func HandleFlags() {
 		if err != nil {
 			log.Fatal("Error creating sample file:", err)
 		}
+		sampleMeta = NewSigMF(*sampleFile)
 	}
 
 	*format = strings.ToLower(*format)
@@ -151,6 +359,51 @@ func HandleFlags() {
 	}
 }
 
+// Parse a comma-separated list of servers of the form name=addr. Servers
+// given without a name are named by their address.
+func ParseServers(value string) (servers []Server, err error) {
+	names := map[string]bool{}
+	for _, s := range strings.Split(value, ",") {
+		name, addr, named := strings.Cut(s, "=")
+		if !named {
+			addr = name
+		}
+		if name == "" || addr == "" {
+			return nil, fmt.Errorf("invalid server: %q", s)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate server name: %q", name)
+		}
+		names[name] = true
+
+		servers = append(servers, Server{name, addr})
+	}
+
+	return servers, nil
+}
+
+// Build the filter chain from flags given.
+func NewFilterChain() (fc protocol.FilterChain) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "unique":
+			if f.Value.String() == "true" {
+				fc.Add(NewUniqueFilter())
+			}
+		case "filterid":
+			fc.Add(meterID)
+		case "filtertype":
+			fc.Add(meterType)
+		case "minrssi":
+			fc.Add(MinRSSIFilter(*minRSSI))
+		case "minsnr":
+			fc.Add(MinSNRFilter(*minSNR))
+		}
+	})
+
+	return fc
+}
+
 // JSON, XML and GOB all implement this interface so we can simplify log
 // output formatting.
 type Encoder interface {
@@ -239,6 +492,21 @@ func (m MeterTypeFilter) Filter(msg protocol.Message) bool {
 	return m.UintMap[uint(msg.MeterType())]
 }
 
+// Signal filters only apply to log messages, which carry signal measurements.
+type MinRSSIFilter float64
+
+func (m MinRSSIFilter) Filter(msg protocol.Message) bool {
+	logMsg, ok := msg.(protocol.LogMessage)
+	return !ok || logMsg.RSSI >= float64(m)
+}
+
+type MinSNRFilter float64
+
+func (m MinSNRFilter) Filter(msg protocol.Message) bool {
+	logMsg, ok := msg.(protocol.LogMessage)
+	return !ok || logMsg.SNR >= float64(m)
+}
+
 type UniqueFilter map[uint][]byte
 
 func NewUniqueFilter() UniqueFilter {
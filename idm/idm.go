@@ -31,13 +31,20 @@ func init() {
 	protocol.RegisterParser("idm", NewParser)
 }
 
+var ccitt = crc.NewCRC("CCITT", 0xFFFF, 0x1021, 0x1D0F)
+
 type Parser struct {
 	crc.CRC
 	cfg  protocol.PacketConfig
 	data protocol.Data
+
+	d        *protocol.Decoder
+	recovery *protocol.Recovery
 }
 
-func (p Parser) SetDecoder(*protocol.Decoder) {}
+func (p *Parser) SetDecoder(d *protocol.Decoder) {
+	p.d = d
+}
 
 func (p Parser) Cfg() protocol.PacketConfig {
 	return p.cfg
@@ -45,7 +52,7 @@ func (p Parser) Cfg() protocol.PacketConfig {
 
 func NewParser(chipLength int) (p protocol.Parser) {
 	return &Parser{
-		CRC: crc.NewCRC("CCITT", 0xFFFF, 0x1021, 0x1D0F),
+		CRC: ccitt,
 		cfg: protocol.PacketConfig{
 			Protocol:        "idm",
 			CenterFreq:      912600155,
@@ -55,13 +62,21 @@ func NewParser(chipLength int) (p protocol.Parser) {
 			PacketSymbols:   92 * 8,
 			Preamble:        "01010101010101010001011010100011",
 		},
-		data: protocol.Data{Bytes: make([]byte, 92)},
+		data:     protocol.Data{Bytes: make([]byte, 92)},
+		recovery: protocol.NewRecovery(ccitt, 92*8, 4, 92),
 	}
 }
 
 func (p Parser) Parse(pkts []protocol.Data, msgCh chan protocol.Message, wg *sync.WaitGroup) {
 	seen := make(map[string]bool)
 
+	// Packets failing the checksum are recovered once intact packets are
+	// parsed.
+	var (
+		accepted []int
+		damaged  []protocol.Data
+	)
+
 	for _, pkt := range pkts {
 		p.data.Idx = pkt.Idx
 		p.data.Bits = pkt.Bits[0:p.cfg.PacketSymbols]
@@ -73,28 +88,42 @@ func (p Parser) Parse(pkts []protocol.Data, msgCh chan protocol.Message, wg *syn
 		}
 		seen[s] = true
 
-		// If the packet checksum fails, bail.
+		// If the packet checksum fails, bail unless it can be recovered.
 		if residue := p.Checksum(p.data.Bytes[4:92]); residue != p.Residue {
+			damaged = append(damaged, pkt)
 			continue
 		}
 
-		// If the serial checksum fails, bail.
-		buf := make([]byte, 6)
-		copy(buf, p.data.Bytes[9:13])
-		copy(buf[4:], p.data.Bytes[88:90])
-		if residue := p.Checksum(buf); residue != p.Residue {
-			continue
+		if p.send(p.data, msgCh, 0) {
+			accepted = append(accepted, pkt.Idx)
 		}
+	}
 
-		idm := NewIDM(p.data)
-		if idm.ERTSerialNumber == 0 {
-			continue
-		}
+	p.recovery.Recover(p.d, damaged, accepted, func(data protocol.Data, flipped int) bool {
+		return p.send(data, msgCh, flipped)
+	})
 
-		msgCh <- idm
+	wg.Done()
+}
+
+// Send the message in a packet which passed its checksum, after flipping
+// the given number of bits. Reports whether the message was sent.
+func (p Parser) send(data protocol.Data, msgCh chan protocol.Message, flipped int) bool {
+	// If the serial checksum fails, bail.
+	buf := make([]byte, 6)
+	copy(buf, data.Bytes[9:13])
+	copy(buf[4:], data.Bytes[88:90])
+	if residue := p.Checksum(buf); residue != p.Residue {
+		return false
 	}
 
-	wg.Done()
+	idm := NewIDM(data)
+	if idm.ERTSerialNumber == 0 {
+		return false
+	}
+
+	msgCh <- protocol.Packet{Message: idm, Idx: data.Idx, Corrected: flipped}
+	return true
 }
 
 // Standard Consumption Message
@@ -128,9 +157,11 @@ func NewIDM(data protocol.Data) (idm IDM) {
 	idm.ERTSerialNumber = binary.BigEndian.Uint32(data.Bytes[9:13])
 	idm.ConsumptionIntervalCount = data.Bytes[13]
 	idm.ModuleProgrammingState = data.Bytes[14]
-	idm.TamperCounters = data.Bytes[15:21]
+	// Copy fields held as bytes, the parser reuses its buffer for the next
+	// packet, possibly before this message is written.
+	idm.TamperCounters = append([]byte(nil), data.Bytes[15:21]...)
 	idm.AsynchronousCounters = binary.BigEndian.Uint16(data.Bytes[21:23])
-	idm.PowerOutageFlags = data.Bytes[23:29]
+	idm.PowerOutageFlags = append([]byte(nil), data.Bytes[23:29]...)
 	idm.LastConsumptionCount = binary.BigEndian.Uint32(data.Bytes[29:33])
 
 	offset := 264
@@ -147,6 +178,39 @@ func NewIDM(data protocol.Data) (idm IDM) {
 	return
 }
 
+// Encode is the inverse of NewIDM, it returns the packet the message would be
+// parsed from. Both checksums are calculated rather than taken from the
+// message.
+func (idm IDM) Encode() protocol.Data {
+	data := make([]byte, 92)
+
+	binary.BigEndian.PutUint32(data[0:4], idm.Preamble)
+	data[4] = idm.PacketTypeID
+	data[5] = idm.PacketLength
+	data[6] = idm.HammingCode
+	data[7] = idm.ApplicationVersion
+	data[8] = idm.ERTType & 0x0F
+	binary.BigEndian.PutUint32(data[9:13], idm.ERTSerialNumber)
+	data[13] = idm.ConsumptionIntervalCount
+	data[14] = idm.ModuleProgrammingState
+	copy(data[15:21], idm.TamperCounters)
+	binary.BigEndian.PutUint16(data[21:23], idm.AsynchronousCounters)
+	copy(data[23:29], idm.PowerOutageFlags)
+	binary.BigEndian.PutUint32(data[29:33], idm.LastConsumptionCount)
+
+	var bits string
+	for _, interval := range idm.DifferentialConsumptionIntervals {
+		bits += fmt.Sprintf("%09b", interval&0x1FF)
+	}
+	copy(data[33:86], protocol.PackBits(bits))
+
+	binary.BigEndian.PutUint16(data[86:88], idm.TransmitTimeOffset)
+	binary.BigEndian.PutUint16(data[88:90], ^ccitt.Checksum(data[9:13]))
+	binary.BigEndian.PutUint16(data[90:92], ^ccitt.Checksum(data[4:90]))
+
+	return protocol.NewData(data)
+}
+
 type Interval [47]uint16
 
 func (interval Interval) Record() (r []string) {
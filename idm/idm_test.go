@@ -0,0 +1,60 @@
+package idm
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/bemasher/rtlamr/protocol"
+)
+
+const (
+	Trials = 512
+)
+
+func randBytes(n int) []byte {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return buf
+}
+
+// Encoded messages must pass the parser's checks and parse to the original.
+func TestRoundTrip(t *testing.T) {
+	p := NewParser(72)
+
+	for trial := 0; trial < Trials; trial++ {
+		idm := IDM{
+			Preamble:                 0x555516A3,
+			PacketTypeID:             0x1C,
+			PacketLength:             0x5C,
+			HammingCode:              uint8(rand.Intn(256)),
+			ApplicationVersion:       uint8(rand.Intn(256)),
+			ERTType:                  uint8(rand.Intn(16)),
+			ERTSerialNumber:          rand.Uint32() | 1,
+			ConsumptionIntervalCount: uint8(rand.Intn(256)),
+			ModuleProgrammingState:   uint8(rand.Intn(256)),
+			TamperCounters:           randBytes(6),
+			AsynchronousCounters:     uint16(rand.Intn(1 << 16)),
+			PowerOutageFlags:         randBytes(6),
+			LastConsumptionCount:     rand.Uint32(),
+			TransmitTimeOffset:       uint16(rand.Intn(1 << 16)),
+		}
+		for idx := range idm.DifferentialConsumptionIntervals {
+			idm.DifferentialConsumptionIntervals[idx] = uint16(rand.Intn(1 << 9))
+		}
+
+		data := idm.Encode()
+
+		pkt, ok := protocol.ParseData(p, data)
+		if !ok {
+			t.Fatalf("%+v: parser rejected %02X", idm, data.Bytes)
+		}
+		msg := pkt.Message
+
+		idm.SerialNumberCRC = msg.(IDM).SerialNumberCRC
+		idm.PacketCRC = msg.(IDM).PacketCRC
+		if !reflect.DeepEqual(msg, idm) {
+			t.Fatalf("expected %+v, got %+v", idm, msg)
+		}
+	}
+}
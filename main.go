@@ -19,11 +19,11 @@ package main
 import (
 	"bytes"
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -44,20 +44,46 @@ import (
 	_ "github.com/bemasher/rtlamr/scmplus"
 )
 
+// Holds rtl_tcp flags, used as the only receiver unless several servers are given.
 var rcvr Receiver
 
 type Receiver struct {
 	rtltcp.SDR
-	d  protocol.Decoder
-	fc protocol.FilterChain
+	d protocol.Decoder
+
+	// Identifies the receiver in output when more than one is running.
+	Name string
+	out  *Output
+
+	src Source
+
+	gainFlagSet bool
+	reconnects  int
+
+	// Frequency correction applied once calibration finishes.
+	cal         *Calibration
+	corrections chan int
+	correction  int
+	corrected   bool
+
+	// Center frequency the source is tuned to, owned by the goroutine reading
+	// samples once running.
+	centerFreq uint32
+	scan       *Scan
+
+	// Resamples samples captured at a rate other than the decoder's, filters
+	// them to a narrower band, or mixes them back from a tuning offset.
+	capture *Capture
 
 	ctx  context.Context
 	canc context.CancelCauseFunc
 	wg   *sync.WaitGroup
 }
 
-func (rcvr *Receiver) NewReceiver(ctx context.Context) {
-	rcvr.ctx, rcvr.canc = context.WithCancelCause(ctx)
+// Receivers share a context, when one stops they all stop.
+func (rcvr *Receiver) NewReceiver(ctx context.Context, canc context.CancelCauseFunc, out *Output) {
+	rcvr.ctx, rcvr.canc = ctx, canc
+	rcvr.out = out
 
 	rcvr.wg = &sync.WaitGroup{}
 
@@ -72,73 +98,186 @@ func (rcvr *Receiver) NewReceiver(ctx context.Context) {
 		msgType["r900"] = true
 	}
 
+	// Each channel split from the band decodes with a decoder of its own.
+	rcvr.d.Cfg.ChipLength = *symbolLength
+	decoders := []*protocol.Decoder{&rcvr.d}
+	if *channels > 0 {
+		decoders = rcvr.d.Channelize(*channels, *symbolLength)
+	}
+
 	// For each given msgType, register it with the decoder.
 	for name := range msgType {
-		p, err := protocol.NewParser(name, *symbolLength)
-		if err != nil {
-			slog.Error("message type", "error", err)
-		}
+		for _, d := range decoders {
+			p, err := protocol.NewParser(name, d.Cfg.ChipLength)
+			if err != nil {
+				slog.Error("message type", "error", err)
+			}
 
-		rcvr.d.RegisterProtocol(p)
+			d.RegisterProtocol(p)
+		}
 	}
 
+	// Tuners supporting only particular sample rates capture at one of them,
+	// resampled to cf32 at the decoder's sample rate. Filtering to a narrower
+	// bandwidth or mixing back from a tuning offset resamples too, even at the
+	// decoder's rate. A -samplerate the decoder already uses needn't resample.
+	captureRate := *captureRate
+	sampleRate := decoders[0].Cfg.DataRate * *symbolLength
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "samplerate" && captureRate == 0 && int(rcvr.Flags.SampleRate) != sampleRate {
+			captureRate = int(rcvr.Flags.SampleRate)
+		}
+	})
+
 	// Allocate the internal buffers of the decoder.
+	rcvr.d.Cfg.SampleFormat = *sampleFormat
+	resample := captureRate != 0 || *bandwidth != 0 || *tuneOffset != 0
+	if resample {
+		rcvr.d.Cfg.SampleFormat = "cf32"
+	}
+	rcvr.d.Cfg.PreambleThreshold = float32(*preambleThreshold)
+	rcvr.d.Cfg.TimingRecovery = *timingRecovery
+	rcvr.d.Cfg.IQCorrection = *iqCorrection
+	if *blanker > 0 {
+		rcvr.d.Cfg.Blanker = float32(math.Pow(10, *blanker/10))
+	}
+	rcvr.d.Cfg.EnergyGate = *energyGate
+	rcvr.d.Cfg.InterferenceCancellation = *sic
 	rcvr.d.Allocate()
 
-	// Connect to rtl_tcp server.
-	if err := rcvr.Connect(); err != nil {
-		rcvr.canc(fmt.Errorf("rcvr.Connect: %w", err))
+	if resample {
+		if captureRate == 0 {
+			captureRate = rcvr.d.Cfg.SampleRate
+		}
+		offset := math.Abs(float64(*tuneOffset))
+		if 2*offset >= float64(captureRate) {
+			rcvr.canc(fmt.Errorf("tuning offset %dHz is beyond the sampled band", *tuneOffset))
+			return
+		}
+		capture, err := NewCapture(*sampleFormat, captureRate, *tuneOffset, *bandwidth, rcvr.d.Cfg)
+		if err != nil {
+			rcvr.canc(err)
+			return
+		}
+		rcvr.capture = capture
+		slog.Info("resampling", "name", rcvr.Name, "capturerate", captureRate, "samplerate", rcvr.d.Cfg.SampleRate, "bandwidth", *bandwidth, "tuneoffset", *tuneOffset)
+
+		// The DC spike is only removed if filtering or decimating rejects it.
+		passband := *bandwidth / 2
+		if passband == 0 {
+			passband = 0.45 * float64(min(captureRate, rcvr.d.Cfg.SampleRate))
+		}
+		if offset != 0 && offset < passband {
+			slog.Warn("tuning offset leaves the DC spike within the decoded band, use -bandwidth or a shorter symbol length", "name", rcvr.Name, "tuneoffset", *tuneOffset, "passband", passband)
+		}
+	}
+
+	src, err := rcvr.OpenSource()
+	if err != nil {
+		rcvr.canc(err)
 		return
 	}
+	rcvr.src = src
 
 	cfg := rcvr.d.Cfg
 
-	gainFlagSet := false
 	flag.Visit(func(f *flag.Flag) {
 		switch f.Name {
 		case "centerfreq":
 			cfg.CenterFreq = uint32(rcvr.Flags.CenterFreq)
-		case "samplerate":
-			cfg.SampleRate = int(rcvr.Flags.SampleRate)
 		case "gainbyindex", "tunergainmode", "tunergain", "agcmode":
-			gainFlagSet = true
-		case "unique":
-			if f.Value.String() == "true" {
-				rcvr.fc.Add(NewUniqueFilter())
-			}
-		case "filterid":
-			rcvr.fc.Add(meterID)
-		case "filtertype":
-			rcvr.fc.Add(meterType)
+			rcvr.gainFlagSet = true
 		}
 	})
 
-	rcvr.SetCenterFreq(cfg.CenterFreq)
-	rcvr.SetSampleRate(uint32(cfg.SampleRate))
+	// Scanning begins on the first frequency given. Time slicing alternates
+	// between the frequencies message types prefer, beginning with the lowest.
+	if scanFreqs != nil {
+		rcvr.scan = NewScan(rcvr.Name, scanFreqs, cfg.SampleRate, *dwell)
+	} else if *timeSlice != 0 {
+		rcvr.scan = NewTimeSlice(rcvr.Name, rcvr.d.CenterFreqs(), cfg.SampleRate, *timeSlice)
+		if rcvr.scan == nil {
+			slog.Info("message types share a center frequency, not time slicing", "name", rcvr.Name)
+		}
+	}
+	if rcvr.scan != nil {
+		cfg.CenterFreq = rcvr.scan.Freq()
+		if rcvr.scan.protocols != nil {
+			rcvr.d.Enable(rcvr.scan.protocols[cfg.CenterFreq])
+		}
+	}
+	rcvr.centerFreq = cfg.CenterFreq
 
-	if !gainFlagSet {
-		rcvr.SetGainMode(true)
+	// Message types transmitting outside the filtered band aren't heard.
+	if *bandwidth != 0 && rcvr.scan == nil {
+		for freq, protocols := range rcvr.d.CenterFreqs() {
+			if math.Abs(float64(freq)-float64(cfg.CenterFreq)) > *bandwidth/2 {
+				slog.Warn("message types outside bandwidth", "name", rcvr.Name, "msgtypes", strings.Join(protocols, ","), "freq", freq)
+			}
+		}
 	}
 
 	rcvr.d.Cfg = cfg
 	rcvr.d.Log()
 
+	if *calibrate != 0 {
+		rcvr.cal = NewCalibration(rcvr.Name, cfg.CenterFreq, rcvr.Flags.FreqCorrection)
+		rcvr.corrections = make(chan int, 1)
+	}
+
+	slog.Info("sample source", "type", *source, "name", rcvr.Name, "realtime", *realTime)
+
+	if sampleMeta != nil {
+		hardware := *source
+		if sdr, ok := rcvr.src.(*rtltcp.SDR); ok {
+			hardware = fmt.Sprintf("rtl_tcp %s tuner, %d gains", sdr.Info.Tuner, sdr.Info.GainCount)
+		}
+		sampleMeta.Configure(cfg, hardware)
+	}
+
+	if err := rcvr.Tune(); err != nil {
+		slog.Warn("tuning sample source", "error", err)
+	}
+
 	// Tell the user how many gain settings were reported by rtl_tcp.
-	slog.Info("rtl_tcp", "GainCount", rcvr.SDR.Info.GainCount)
+	if sdr, ok := rcvr.src.(*rtltcp.SDR); ok {
+		slog.Info("rtl_tcp", "GainCount", sdr.Info.GainCount)
+	}
 }
 
 func (rcvr *Receiver) Close() {
 	rcvr.wg.Wait()
-	rcvr.SDR.Close()
+	if rcvr.src != nil {
+		rcvr.src.Close()
+	}
+	if rcvr.scan != nil {
+		rcvr.scan.Log()
+	}
+	if *blanker > 0 || *energyGate {
+		blanked, blocks, skipped := rcvr.d.GateStats()
+		slog.Info("impulses and energy gate", "name", rcvr.Name, "blanked", blanked, "blocks", blocks, "skipped", skipped)
+	}
+	if *sic {
+		collisions, recovered := rcvr.d.CancellationStats()
+		slog.Info("interference cancellation", "name", rcvr.Name, "collisions", collisions, "recovered", recovered)
+	}
+	if rcvr.reconnects > 0 {
+		slog.Info("sample source reconnects", "name", rcvr.Name, "count", rcvr.reconnects)
+	}
 }
 
 func (rcvr *Receiver) Run() {
+	// Nothing to do if the source couldn't be opened.
+	if rcvr.src == nil {
+		return
+	}
+
 	rcvr.wg.Add(3)
 
 	sampleBuf := &bytes.Buffer{}
 
 	// Allocate a channel of blocks.
-	blockCh := make(chan []byte)
+	blockCh := make(chan sampleBlock)
 
 	// Make maps for tracking messages spanning sample blocks.
 	prev := map[protocol.Digest]bool{}
@@ -162,44 +301,110 @@ func (rcvr *Receiver) Run() {
 
 		bytesRead := 0
 
+		// Used to pace reads at the configured sample rate.
+		start := time.Now()
+		samplesRead := 0
+
+		// Set after reconnecting so the decoder discards partial blocks.
+		reset := false
+
 		for {
-			block := make([]byte, rcvr.d.Cfg.BlockSize2)
+			// Apply the correction recommended by calibration.
+			select {
+			case ppm := <-rcvr.corrections:
+				if err := rcvr.Correct(ppm); err != nil {
+					slog.Warn("applying frequency correction", "name", rcvr.Name, "error", err)
+				} else {
+					slog.Info("applied frequency correction", "name", rcvr.Name, "freqcorrection", ppm)
+				}
+			default:
+			}
+
+			block := make([]byte, rcvr.d.Cfg.BlockSize*rcvr.d.Cfg.SampleSize)
+
+			// Read new sample block.
+			var n int
+			var err error
+			if rcvr.capture != nil {
+				n, err = rcvr.capture.ReadBlock(rcvr.src, block)
+			} else {
+				n, err = readBlock(rcvr.src, block)
+			}
+			bytesRead += n
+			received := time.Now()
+
+			// Network sources may be reconnected after any error.
+			if err != nil && *reconnect && isNetworkSource(*source) {
+				slog.Warn("sample source read failed", "name", rcvr.Name, "error", err)
+				if err := rcvr.Reconnect(); err != nil {
+					rcvr.canc(fmt.Errorf("rcvr.Reconnect: %w", err))
+					return
+				}
+				start, samplesRead = time.Now(), 0
+				reset = true
+				if rcvr.capture != nil {
+					rcvr.capture.Reset()
+				}
+				continue
+			}
 
-			err := rcvr.SetDeadline(time.Now().Add(5 * time.Second))
+			// A partial block at the end of the stream is discarded.
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				rcvr.canc(fmt.Errorf("end of input: %w", io.EOF))
+				return
+			}
 			if err != nil {
-				rcvr.canc(fmt.Errorf("rcvr.SetDeadline: %w", err))
+				rcvr.canc(fmt.Errorf("readBlock: %w", err))
 				return
 			}
 
-			// Read new sample block.
-			for offset := 0; offset < len(block); {
-				var n int
+			// Sleep until the wall clock catches up with the samples read.
+			samplesRead += n / rcvr.d.Cfg.SampleSize
+			if *realTime {
+				elapsed := time.Duration(samplesRead) * time.Second / time.Duration(rcvr.d.Cfg.SampleRate)
+				time.Sleep(time.Until(start.Add(elapsed)))
+			}
 
-				n, err = rcvr.Read(block[offset:])
-				if err != nil {
-					rcvr.canc(fmt.Errorf("rcvr.Read: %w", err))
-					return
+			// Retune once the dwell on this frequency is over. Samples read while
+			// the tuner settles are discarded and the decoder starts afresh on
+			// the new frequency.
+			freq, retuned := rcvr.centerFreq, false
+			if rcvr.scan != nil {
+				next, retune, discard := rcvr.scan.Advance(n / rcvr.d.Cfg.SampleSize)
+				if discard {
+					continue
+				}
+				if retune {
+					if err := rcvr.Retune(next); err != nil {
+						slog.Warn("retuning sample source", "name", rcvr.Name, "error", err)
+					}
+					if rcvr.capture != nil {
+						rcvr.capture.Reset()
+					}
+					retuned = true
 				}
-
-				offset += n
-				bytesRead += n
 			}
 
-			select {
-			case <-tick:
-				// Complain if received samples are less than 90% configured rate.
-				if bytesRead>>1 < (rcvr.d.Cfg.SampleRate * 9 / 10) {
-					slog.Warn("not keeping up with rtl_tcp", "rate", bytesRead>>1)
+			// Files are read as fast as possible unless paced.
+			if *source != "file" {
+				select {
+				case <-tick:
+					// Complain if received samples are less than 90% configured rate.
+					rate := bytesRead / rcvr.d.Cfg.SampleSize
+					if rate < (rcvr.d.Cfg.SampleRate * 9 / 10) {
+						slog.Warn("not keeping up with sample source", "rate", rate)
+					}
+					bytesRead = 0
+				default:
 				}
-				bytesRead = 0
-			default:
 			}
 
 			select {
 			// Exit if we've been told to stop.
 			case <-rcvr.ctx.Done():
 				return
-			case blockCh <- block: // Send the sample block.
+			case blockCh <- sampleBlock{block, reset, freq, received}: // Send the sample block.
+				reset = retuned
 			}
 		}
 	}()
@@ -217,6 +422,24 @@ func (rcvr *Receiver) Run() {
 					continue
 				}
 
+				// Decoders tag messages relative to the frequency scanned, and
+				// when time slicing decode only the message types it's for.
+				if rcvr.scan != nil && block.freq != rcvr.d.Cfg.CenterFreq {
+					rcvr.d.Cfg.CenterFreq = block.freq
+					if rcvr.scan.protocols != nil {
+						rcvr.d.Enable(rcvr.scan.protocols[block.freq])
+					}
+				}
+
+				// Discard state left over from before a reconnect or retune.
+				if block.reset {
+					rcvr.d.Reset()
+					sampleBuf.Reset()
+					for key := range prev {
+						delete(prev, key)
+					}
+				}
+
 				// Clear next map for this sample block.
 				for key := range next {
 					delete(next, key)
@@ -224,26 +447,42 @@ func (rcvr *Receiver) Run() {
 
 				// Discard the oldest block from the buffer if
 				// it's full and write the new block to it.
-				if sampleBuf.Len() > rcvr.d.Cfg.BufferLength<<1 {
-					io.CopyN(io.Discard, sampleBuf, int64(len(block)))
+				if sampleBuf.Len() > rcvr.d.Cfg.BufferLength*rcvr.d.Cfg.SampleSize {
+					io.CopyN(io.Discard, sampleBuf, int64(len(block.samples)))
 				}
-				sampleBuf.Write(block)
+				sampleBuf.Write(block.samples)
 
 				pktFound := false
 
-				// For each message returned
-				for msg := range rcvr.d.Decode(block) {
-					// If the filterchain rejects the message, skip it.
-					if !rcvr.fc.Match(msg) {
-						continue
-					}
+				// Messages found in this block are written to the sample file at this offset.
+				var sampleOffset int64
+				if s, ok := sampleWriter.(io.Seeker); ok {
+					sampleOffset, _ = s.Seek(0, io.SeekCurrent)
+				}
 
+				// Packets span samples relative to the block, which ends the buffer.
+				ss := rcvr.d.Cfg.SampleSize
+				bufSamples := int64(sampleBuf.Len() / ss)
+				blockStart := bufSamples - int64(len(block.samples)/ss)
+
+				// For each message returned
+				for msg := range rcvr.d.Decode(block.samples) {
 					// Make a new LogMessage
 					var logMsg protocol.LogMessage
-					logMsg.Time = time.Now()
-					if s, ok := sampleWriter.(io.Seeker); ok {
-						logMsg.Offset, _ = s.Seek(0, io.SeekCurrent)
+					pktStart, pktEnd := int64(0), bufSamples
+					if pkt, ok := msg.(protocol.Packet); ok {
+						pktStart = min(max(blockStart+int64(pkt.Start), 0), bufSamples)
+						pktEnd = min(max(pktStart+int64(pkt.Length), pktStart), bufSamples)
+						msg = pkt.Message
+						logMsg.Signal = pkt.Signal
+						logMsg.Corrected = pkt.Corrected
+						logMsg.Frequency = pkt.Frequency
+					}
+					if logMsg.Frequency == 0 && rcvr.scan != nil {
+						logMsg.Frequency = block.freq
 					}
+					logMsg.Time = time.Now()
+					logMsg.Offset = sampleOffset
 					logMsg.Length = sampleBuf.Len()
 					logMsg.Type = msg.MsgType()
 					logMsg.Message = msg
@@ -259,20 +498,27 @@ func (rcvr *Receiver) Run() {
 						continue
 					}
 
-					// Encode the message
-					err := encoder.Encode(logMsg)
-					if err != nil {
-						rcvr.canc(fmt.Errorf("encoder.Encode: %w", err))
-						return
+					// Filter, merge and encode the message.
+					if !rcvr.out.Emit(rcvr.Name, logMsg) {
+						continue
+					}
+
+					if sampleMeta != nil {
+						sampleMeta.Annotate(logMsg, sampleOffset/int64(ss)+pktStart, pktEnd-pktStart)
+					}
+					if rcvr.cal != nil {
+						rcvr.cal.Add(logMsg)
+					}
+					if rcvr.scan != nil {
+						rcvr.scan.Add(block.freq, logMsg)
 					}
 
 					pktFound = true
-					if *single {
-						if len(meterID.UintMap) == 0 {
-							break
-						} else {
-							delete(meterID.UintMap, uint(msg.MeterID()))
-						}
+				}
+
+				if rcvr.cal != nil {
+					if ppm, ok := rcvr.cal.Finish(time.Now()); ok && *applyCorrection {
+						rcvr.corrections <- ppm
 					}
 				}
 
@@ -282,9 +528,8 @@ func (rcvr *Receiver) Run() {
 						slog.Error("error writing raw samples to file", "error", err)
 						os.Exit(1)
 					}
-					if *single && len(meterID.UintMap) == 0 {
-						rcvr.canc(errors.New("single: received messages from all meters"))
-						return
+					if sampleMeta != nil {
+						sampleMeta.Capture(sampleOffset, sampleBuf.Len(), block.freq, block.t)
 					}
 				}
 
@@ -344,6 +589,11 @@ func main() {
 			slog.Info("closing sampleWriter")
 			c.Close()
 		}
+		if sampleMeta != nil {
+			if err := sampleMeta.Close(); err != nil {
+				slog.Error("error writing sample metadata", "error", err)
+			}
+		}
 	}()
 
 	// Set context timeout when provided.
@@ -352,17 +602,39 @@ func main() {
 		defer canc()
 	}
 
-	rcvr.NewReceiver(ctx)
-	defer rcvr.Close()
+	rcvrCtx, rcvrCanc := context.WithCancelCause(ctx)
+	defer rcvrCanc(nil)
+
+	// Without several servers, the flag-holding receiver is the only receiver.
+	rcvrs := []*Receiver{&rcvr}
+	window := time.Duration(0)
+	if len(servers) > 1 {
+		rcvrs = rcvrs[:0]
+		for _, server := range servers {
+			r := &Receiver{Name: server.Name}
+			r.Flags = rcvr.Flags
+			r.Flags.ServerAddr = server.Addr
+			rcvrs = append(rcvrs, r)
+		}
+		window = *dedupWindow
+	}
+
+	out := NewOutput(rcvrCanc, NewFilterChain(), window)
+	defer out.Close()
+
+	for _, r := range rcvrs {
+		r.NewReceiver(rcvrCtx, rcvrCanc, out)
+		defer r.Close()
 
-	rcvr.Run()
+		r.Run()
+	}
 
 	select {
 	case <-ctx.Done():
 		err := context.Cause(ctx)
 		slog.Info("main context cancelled", "cause", err)
-	case <-rcvr.ctx.Done():
-		err := context.Cause(rcvr.ctx)
+	case <-rcvrCtx.Done():
+		err := context.Cause(rcvrCtx)
 		slog.Info("receiver context cancelled", "cause", err)
 	}
 }
@@ -0,0 +1,137 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"math"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/protocol"
+	"github.com/bemasher/rtlamr/sim"
+)
+
+// Passes decoded messages to the test.
+type chanEncoder chan protocol.LogMessage
+
+func (enc chanEncoder) Encode(v interface{}) error {
+	enc <- v.(protocol.LogMessage)
+	return nil
+}
+
+func TestMain(m *testing.M) {
+	rcvr.RegisterFlags()
+	RegisterFlags()
+	flag.Parse()
+	os.Exit(m.Run())
+}
+
+// Receive from the simulator over rtl_tcp until a message from each meter is
+// decoded.
+func TestSimulator(t *testing.T) {
+	meters := []sim.Meter{
+		{Protocol: "scm", ID: 12345678, Type: 12, Consumption: 1000},
+		{Protocol: "scm+", ID: 23456789, Type: 7, Consumption: 2000},
+		{Protocol: "idm", ID: 34567890, Type: 8, Consumption: 3000},
+		{Protocol: "r900", ID: 1234567890, Consumption: 5000},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	srv := sim.Server{
+		Config: sim.Config{
+			SampleRate: sim.ChipRate * 32,
+			SNR:        20,
+			FreqOffset: 2000,
+			Interval:   50 * time.Millisecond,
+			Seed:       1,
+		},
+		Meters: meters,
+	}
+	go srv.Serve(l)
+
+	err = flag.CommandLine.Parse([]string{
+		"-server", l.Addr().String(),
+		"-msgtype", "scm,scm+,idm,r900",
+		"-symbollength", "32",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	HandleFlags()
+
+	enc := make(chanEncoder)
+	encoder = enc
+
+	ctx, canc := context.WithCancelCause(context.Background())
+	out := NewOutput(canc, NewFilterChain(), 0)
+
+	rcvr.NewReceiver(ctx, canc, out)
+	rcvr.Run()
+
+	defer func() {
+		canc(errors.New("test finished"))
+		// Drain messages decoded while stopping.
+		go func() {
+			for range enc {
+			}
+		}()
+		rcvr.Close()
+		out.Close()
+		close(enc)
+	}()
+
+	timeout := time.After(10 * time.Second)
+	remaining := map[uint32]sim.Meter{}
+	for _, m := range meters {
+		remaining[m.ID] = m
+	}
+
+	for len(remaining) > 0 {
+		select {
+		case msg := <-enc:
+			m, ok := remaining[msg.MeterID()]
+			if !ok {
+				continue
+			}
+			if msg.MeterType() != m.Type {
+				t.Errorf("%s: expected type %d, got %d", m.Protocol, m.Type, msg.MeterType())
+			}
+			if math.Abs(msg.SNR-srv.Config.SNR) > 2 {
+				t.Errorf("%s: expected SNR near %.1f, got %.1f", m.Protocol, srv.Config.SNR, msg.SNR)
+			}
+			offset := float64(sim.TransmitFreq(m.Protocol)) - float64(rcvr.d.Cfg.CenterFreq) + srv.Config.FreqOffset
+			if math.Abs(msg.FreqOffset-offset) > 200 {
+				t.Errorf("%s: expected frequency offset near %.0f, got %.0f", m.Protocol, offset, msg.FreqOffset)
+			}
+			delete(remaining, m.ID)
+		case <-ctx.Done():
+			t.Fatal(context.Cause(ctx))
+		case <-timeout:
+			t.Fatalf("timed out waiting for meters: %v", remaining)
+		}
+	}
+}
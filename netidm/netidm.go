@@ -31,6 +31,8 @@ func init() {
 	protocol.RegisterParser("netidm", NewParser)
 }
 
+var ccitt = crc.NewCRC("CCITT", 0xFFFF, 0x1021, 0x1D0F)
+
 func NewPacketConfig(chipLength int) (cfg protocol.PacketConfig) {
 	cfg.CenterFreq = 912600155
 	cfg.DataRate = 32768
@@ -46,9 +48,14 @@ type Parser struct {
 	crc.CRC
 	cfg  protocol.PacketConfig
 	data protocol.Data
+
+	d        *protocol.Decoder
+	recovery *protocol.Recovery
 }
 
-func (p Parser) SetDecoder(d *protocol.Decoder) {}
+func (p *Parser) SetDecoder(d *protocol.Decoder) {
+	p.d = d
+}
 
 func (p *Parser) Cfg() protocol.PacketConfig {
 	return p.cfg
@@ -56,7 +63,7 @@ func (p *Parser) Cfg() protocol.PacketConfig {
 
 func NewParser(chipLength int) (p protocol.Parser) {
 	return &Parser{
-		CRC: crc.NewCRC("CCITT", 0xFFFF, 0x1021, 0x1D0F),
+		CRC: ccitt,
 		cfg: protocol.PacketConfig{
 			Protocol:        "netidm",
 			CenterFreq:      912600155,
@@ -66,13 +73,21 @@ func NewParser(chipLength int) (p protocol.Parser) {
 			PacketSymbols:   92 * 8,
 			Preamble:        "01010101010101010001011010100011",
 		},
-		data: protocol.Data{Bytes: make([]byte, 92)},
+		data:     protocol.Data{Bytes: make([]byte, 92)},
+		recovery: protocol.NewRecovery(ccitt, 92*8, 4, 92),
 	}
 }
 
 func (p Parser) Parse(pkts []protocol.Data, msgCh chan protocol.Message, wg *sync.WaitGroup) {
 	seen := make(map[string]bool)
 
+	// Packets failing the checksum are recovered once intact packets are
+	// parsed.
+	var (
+		accepted []int
+		damaged  []protocol.Data
+	)
+
 	for _, pkt := range pkts {
 		p.data.Idx = pkt.Idx
 		p.data.Bits = pkt.Bits[0:p.cfg.PacketSymbols]
@@ -84,30 +99,44 @@ func (p Parser) Parse(pkts []protocol.Data, msgCh chan protocol.Message, wg *syn
 		}
 		seen[s] = true
 
-		// If the checksum fails, bail.
+		// If the checksum fails, bail unless it can be recovered.
 		if residue := p.Checksum(p.data.Bytes[4:92]); residue != p.Residue {
+			damaged = append(damaged, pkt)
 			continue
 		}
 
-		// If the serial checksum fails, bail.
-		buf := make([]byte, 6)
-		copy(buf, p.data.Bytes[9:13])
-		copy(buf[4:], p.data.Bytes[88:90])
-		if residue := p.Checksum(buf); residue != p.Residue {
-			continue
+		if p.send(p.data, msgCh, 0) {
+			accepted = append(accepted, pkt.Idx)
 		}
+	}
 
-		netidm := NewNetIDM(p.data)
+	p.recovery.Recover(p.d, damaged, accepted, func(data protocol.Data, flipped int) bool {
+		return p.send(data, msgCh, flipped)
+	})
 
-		// If the meter id is 0, bail.
-		if netidm.ERTSerialNumber == 0 {
-			continue
-		}
+	wg.Done()
+}
 
-		msgCh <- netidm
+// Send the message in a packet which passed its checksum, after flipping
+// the given number of bits. Reports whether the message was sent.
+func (p Parser) send(data protocol.Data, msgCh chan protocol.Message, flipped int) bool {
+	// If the serial checksum fails, bail.
+	buf := make([]byte, 6)
+	copy(buf, data.Bytes[9:13])
+	copy(buf[4:], data.Bytes[88:90])
+	if residue := p.Checksum(buf); residue != p.Residue {
+		return false
 	}
 
-	wg.Done()
+	netidm := NewNetIDM(data)
+
+	// If the meter id is 0, bail.
+	if netidm.ERTSerialNumber == 0 {
+		return false
+	}
+
+	msgCh <- protocol.Packet{Message: netidm, Idx: data.Idx, Corrected: flipped}
+	return true
 }
 
 // Net Meter Interval Data Message
@@ -160,6 +189,39 @@ func NewNetIDM(data protocol.Data) (netidm NetIDM) {
 	return
 }
 
+// Encode is the inverse of NewNetIDM, it returns the packet the message would
+// be parsed from. Bytes the message doesn't hold are zero and both checksums
+// are calculated rather than taken from the message.
+func (netidm NetIDM) Encode() protocol.Data {
+	data := make([]byte, 92)
+
+	binary.BigEndian.PutUint32(data[0:4], netidm.Preamble)
+	data[4] = netidm.ProtocolID
+	data[5] = netidm.PacketLength
+	data[6] = netidm.HammingCode
+	data[7] = netidm.ApplicationVersion
+	data[8] = netidm.ERTType & 0x0F
+	binary.BigEndian.PutUint32(data[9:13], netidm.ERTSerialNumber)
+	data[13] = netidm.ConsumptionIntervalCount
+	data[14] = netidm.ProgrammingState
+
+	data[25], data[26], data[27] = byte(netidm.LastConsumption>>16), byte(netidm.LastConsumption>>8), byte(netidm.LastConsumption)
+	data[28], data[29], data[30] = byte(netidm.LastGeneration>>16), byte(netidm.LastGeneration>>8), byte(netidm.LastGeneration)
+	binary.BigEndian.PutUint32(data[34:38], netidm.LastConsumptionNet)
+
+	var bits string
+	for _, interval := range netidm.DifferentialConsumptionIntervals {
+		bits += fmt.Sprintf("%014b", interval&0x3FFF)
+	}
+	copy(data[38:86], protocol.PackBits(bits))
+
+	binary.BigEndian.PutUint16(data[86:88], netidm.TransmitTimeOffset)
+	binary.BigEndian.PutUint16(data[88:90], ^ccitt.Checksum(data[9:13]))
+	binary.BigEndian.PutUint16(data[90:92], ^ccitt.Checksum(data[4:90]))
+
+	return protocol.NewData(data)
+}
+
 type Interval [27]uint16
 
 func (interval Interval) Record() (r []string) {
@@ -0,0 +1,52 @@
+package netidm
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/bemasher/rtlamr/protocol"
+)
+
+const (
+	Trials = 512
+)
+
+// Encoded messages must pass the parser's checks and parse to the original.
+func TestRoundTrip(t *testing.T) {
+	p := NewParser(72)
+
+	for trial := 0; trial < Trials; trial++ {
+		netidm := NetIDM{
+			Preamble:                 0x555516A3,
+			ProtocolID:               0x1C,
+			PacketLength:             0x5C,
+			HammingCode:              uint8(rand.Intn(256)),
+			ApplicationVersion:       uint8(rand.Intn(256)),
+			ERTType:                  uint8(rand.Intn(16)),
+			ERTSerialNumber:          rand.Uint32() | 1,
+			ConsumptionIntervalCount: uint8(rand.Intn(256)),
+			ProgrammingState:         uint8(rand.Intn(256)),
+			LastGeneration:           rand.Uint32() & 0xFFFFFF,
+			LastConsumption:          rand.Uint32() & 0xFFFFFF,
+			LastConsumptionNet:       rand.Uint32(),
+			TransmitTimeOffset:       uint16(rand.Intn(1 << 16)),
+		}
+		for idx := range netidm.DifferentialConsumptionIntervals {
+			netidm.DifferentialConsumptionIntervals[idx] = uint16(rand.Intn(1 << 14))
+		}
+
+		data := netidm.Encode()
+
+		pkt, ok := protocol.ParseData(p, data)
+		if !ok {
+			t.Fatalf("%+v: parser rejected %02X", netidm, data.Bytes)
+		}
+		msg := pkt.Message
+
+		netidm.SerialNumberCRC = msg.(NetIDM).SerialNumberCRC
+		netidm.PacketCRC = msg.(NetIDM).PacketCRC
+		if msg != netidm {
+			t.Fatalf("expected %+v, got %+v", netidm, msg)
+		}
+	}
+}
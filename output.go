@@ -0,0 +1,178 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bemasher/rtlamr/protocol"
+)
+
+// Output is shared by all receivers. It applies the filter chain to decoded
+// messages and encodes them. When more than one receiver is running, identical
+// messages heard by several receivers within a time window are merged into a
+// single message listing each receiver that heard it.
+type Output struct {
+	fc     protocol.FilterChain
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[protocol.Digest]*protocol.LogMessage
+	done    bool
+
+	canc context.CancelCauseFunc
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Make a new output. If window is non-zero, messages are held for the
+// duration of the window to merge duplicates from other receivers.
+func NewOutput(canc context.CancelCauseFunc, fc protocol.FilterChain, window time.Duration) *Output {
+	out := &Output{
+		fc:      fc,
+		window:  window,
+		pending: map[protocol.Digest]*protocol.LogMessage{},
+		canc:    canc,
+		stop:    make(chan struct{}),
+	}
+
+	if window != 0 {
+		out.wg.Add(1)
+		go out.run()
+	}
+
+	return out
+}
+
+// Periodically encode pending messages whose window has expired.
+func (out *Output) run() {
+	defer out.wg.Done()
+
+	tick := time.NewTicker(max(out.window/4, 10*time.Millisecond))
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-out.stop:
+			return
+		case now := <-tick.C:
+			out.mu.Lock()
+			out.flush(now.Add(-out.window))
+			out.mu.Unlock()
+		}
+	}
+}
+
+// Encode pending messages first heard before the given time, oldest first.
+// Must be called with the mutex held.
+func (out *Output) flush(before time.Time) {
+	var expired []*protocol.LogMessage
+	for digest, msg := range out.pending {
+		if msg.Time.Before(before) {
+			expired = append(expired, msg)
+			delete(out.pending, digest)
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Time.Before(expired[j].Time)
+	})
+
+	for _, msg := range expired {
+		out.encode(*msg)
+	}
+}
+
+// Given a message decoded by the named receiver, apply the filter chain and
+// either encode it or hold it for merging. Reports whether the message was
+// accepted, duplicates of pending messages are not.
+func (out *Output) Emit(name string, msg protocol.LogMessage) bool {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+
+	if out.done {
+		return false
+	}
+
+	digest := protocol.NewDigest(msg.Message)
+
+	// Another receiver already heard this message, add this receiver to it.
+	if pending, ok := out.pending[digest]; ok {
+		receivers := strings.Split(pending.Receiver, ",")
+		if !slices.Contains(receivers, name) {
+			pending.Receiver += "," + name
+		}
+		return false
+	}
+
+	// If the filterchain rejects the message, skip it.
+	if !out.fc.Match(msg) {
+		return false
+	}
+
+	msg.Receiver = name
+
+	if out.window == 0 {
+		out.encode(msg)
+	} else {
+		out.pending[digest] = &msg
+	}
+
+	return true
+}
+
+// Encode the message and stop the receivers once -single is satisfied. Must
+// be called with the mutex held.
+func (out *Output) encode(msg protocol.LogMessage) {
+	if out.done {
+		return
+	}
+
+	err := encoder.Encode(msg)
+	if err != nil {
+		out.done = true
+		out.canc(fmt.Errorf("encoder.Encode: %w", err))
+		return
+	}
+
+	if *single {
+		delete(meterID.UintMap, uint(msg.MeterID()))
+		if len(meterID.UintMap) == 0 {
+			out.done = true
+			out.canc(errors.New("single: received messages from all meters"))
+		}
+	}
+}
+
+// Stop merging and encode any pending messages. Must only be called after
+// all receivers have stopped.
+func (out *Output) Close() {
+	close(out.stop)
+	out.wg.Wait()
+
+	// Every pending message was heard less than a window ago.
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	out.flush(time.Now().Add(out.window))
+}
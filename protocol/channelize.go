@@ -0,0 +1,254 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"encoding/binary"
+	"log"
+	"math"
+	"math/cmplx"
+	"sync"
+)
+
+// Spacing of the channels ERT meters hop between in Hz, see misc/modes.go.
+const ChannelWidth = 196568
+
+// Channels keep at least this many samples per chip, twice the channel width
+// at the ERT data rate.
+const minChannelChipLength = 12
+
+// A channel is a slice of the band around the center frequency mixed down to
+// baseband, low pass filtered and decimated for a decoder of its own.
+type channel struct {
+	*Decoder
+
+	offset float64 // From the center frequency in Hz.
+
+	// Oscillator mixing the channel down to baseband.
+	rot, phase complex128
+
+	taps []float32
+
+	// Mixed samples, beginning with the end of the previous block the filter
+	// still needs.
+	mixed []complex64
+
+	// Decimated samples, interleaved cf32.
+	out []byte
+}
+
+// Channelize splits the band around the center frequency into n channels
+// ChannelWidth apart, each decoded by a decoder of its own. The sample rate
+// is decimated for the channels by the largest factor of chipLength which
+// leaves them minChannelChipLength samples per chip. Returns the decoder of
+// each channel, protocols are registered with them rather than d.
+func (d *Decoder) Channelize(n, chipLength int) []*Decoder {
+	d.Cfg.ChipLength = chipLength
+
+	d.decimation = 1
+	for factor := chipLength; factor > 1; factor-- {
+		if chipLength%factor == 0 && chipLength/factor >= minChannelChipLength {
+			d.decimation = factor
+			break
+		}
+	}
+
+	decoders := make([]*Decoder, n)
+	d.channels = make([]*channel, n)
+	for idx := range d.channels {
+		c := NewDecoder()
+		c.Cfg.ChipLength = chipLength / d.decimation
+		c.Cfg.SampleFormat = "cf32"
+
+		decoders[idx] = &c
+		d.channels[idx] = &channel{
+			Decoder: &c,
+			offset:  (float64(idx) - float64(n-1)/2) * ChannelWidth,
+		}
+	}
+
+	return decoders
+}
+
+// Allocate the buffers of each channel and the wideband configuration they
+// are decimated from.
+func (d *Decoder) allocateChannels() {
+	if _, ok := d.demod.(ComplexDemodulator); !ok {
+		panic("channelizing requires a complex sample format")
+	}
+
+	for _, c := range d.channels {
+		c.Cfg.PreambleThreshold = d.Cfg.PreambleThreshold
+		c.Cfg.TimingRecovery = d.Cfg.TimingRecovery
+		c.Cfg.EnergyGate = d.Cfg.EnergyGate
+		c.Cfg.InterferenceCancellation = d.Cfg.InterferenceCancellation
+		c.Allocate()
+	}
+
+	first := d.channels[0].Cfg
+	d.Cfg.CenterFreq = first.CenterFreq
+	d.Cfg.DataRate = first.DataRate
+	if d.Cfg.SampleRate == 0 {
+		d.Cfg.SampleRate = first.SampleRate * d.decimation
+	}
+	d.Cfg.BlockSize = first.BlockSize * d.decimation
+	d.Cfg.BlockSize2 = d.Cfg.BlockSize << 1
+	d.Cfg.BufferLength = first.BufferLength * d.decimation
+
+	// Channels beyond the sampled band can't be decoded.
+	sampleRate := float64(d.Cfg.SampleRate)
+	channels := d.channels[:0]
+	for _, c := range d.channels {
+		if math.Abs(c.offset)+ChannelWidth/2 > sampleRate/2 {
+			log.Printf("channel %.0fHz from center is outside the sampled band", c.offset)
+			continue
+		}
+		channels = append(channels, c)
+	}
+	d.channels = channels
+
+	// Windowed sinc low pass filter, passing signals up to a quarter of the
+	// channel width beyond its edges so that meters between channels are
+	// heard by both.
+	taps := make([]float32, 16*d.decimation+1)
+	cutoff := 0.75 * ChannelWidth / sampleRate
+	var sum float32
+	for idx := range taps {
+		t := float64(idx - len(taps)/2)
+		h := 2 * cutoff
+		if t != 0 {
+			h = math.Sin(2*math.Pi*cutoff*t) / (math.Pi * t)
+		}
+		h *= 0.54 - 0.46*math.Cos(2*math.Pi*float64(idx)/float64(len(taps)-1))
+		taps[idx] = float32(h)
+		sum += taps[idx]
+	}
+	for idx := range taps {
+		taps[idx] /= sum
+	}
+
+	d.iq = make([]complex64, d.Cfg.BlockSize)
+	d.Signal = make([]float32, d.Cfg.BlockSize)
+	for _, c := range d.channels {
+		c.rot = cmplx.Exp(complex(0, -2*math.Pi*c.offset/sampleRate))
+		c.phase = 1
+		c.taps = taps
+		c.mixed = make([]complex64, len(taps)-1+d.Cfg.BlockSize)
+		c.out = make([]byte, c.Cfg.BlockSize*c.Cfg.SampleSize)
+	}
+}
+
+// Decode a block of samples on every channel at once. Meters between
+// channels are heard on both, only the strongest copy of each message is
+// kept.
+func (d Decoder) decodeChannels(input []byte) chan Message {
+	d.demod.(ComplexDemodulator).Complex(input, d.iq)
+
+	// Impulses are blanked before filtering spreads them.
+	if d.Cfg.Blanker > 0 {
+		d.noise.update(d.blankComplex(d.iq, d.Signal), len(d.iq))
+	}
+
+	found := make([][]Message, len(d.channels))
+
+	var wg sync.WaitGroup
+	for idx, c := range d.channels {
+		wg.Add(1)
+		go func(idx int, c *channel) {
+			defer wg.Done()
+			found[idx] = c.decode(d.iq, d.Cfg.CenterFreq)
+		}(idx, c)
+	}
+	wg.Wait()
+
+	var msgs []Message
+	strongest := map[Digest]int{}
+	for _, channelMsgs := range found {
+		for _, msg := range channelMsgs {
+			pkt, ok := msg.(Packet)
+			if !ok {
+				msgs = append(msgs, msg)
+				continue
+			}
+
+			digest := NewDigest(pkt.Message)
+			if idx, seen := strongest[digest]; seen {
+				if pkt.SNR > msgs[idx].(Packet).SNR {
+					msgs[idx] = pkt
+				}
+				continue
+			}
+			strongest[digest] = len(msgs)
+			msgs = append(msgs, pkt)
+		}
+	}
+
+	msgCh := make(chan Message, len(msgs))
+	for _, msg := range msgs {
+		msgCh <- msg
+	}
+	close(msgCh)
+
+	return msgCh
+}
+
+// Mix, filter and decimate a block of samples, returning the messages its
+// decoder finds in them. Messages are tagged with the channel's frequency and
+// their frequency offset is from the center frequency rather than the
+// channel's.
+func (c *channel) decode(iq []complex64, centerFreq uint32) (msgs []Message) {
+	history := len(c.taps) - 1
+
+	// Mix the channel down to baseband.
+	mixed := c.mixed[history:]
+	for idx, v := range iq {
+		mixed[idx] = v * complex64(c.phase)
+		c.phase *= c.rot
+	}
+	c.phase /= complex(cmplx.Abs(c.phase), 0)
+
+	// Filter only the samples kept after decimation.
+	decimation := len(iq) / c.Cfg.BlockSize
+	for idx := 0; idx < c.Cfg.BlockSize; idx++ {
+		x := c.mixed[idx*decimation : idx*decimation+len(c.taps)]
+		taps := c.taps[:len(x)]
+
+		var re, im float32
+		for t, v := range x {
+			re += taps[t] * real(v)
+			im += taps[t] * imag(v)
+		}
+
+		binary.LittleEndian.PutUint32(c.out[idx*8:], math.Float32bits(re))
+		binary.LittleEndian.PutUint32(c.out[idx*8+4:], math.Float32bits(im))
+	}
+	copy(c.mixed, c.mixed[len(iq):])
+
+	freq := uint32(int64(centerFreq) + int64(c.offset))
+	for msg := range c.Decode(c.out) {
+		if pkt, ok := msg.(Packet); ok {
+			pkt.Frequency = freq
+			pkt.FreqOffset += c.offset
+			pkt.Start *= decimation
+			pkt.Length *= decimation
+			msg = pkt
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs
+}
@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Packets transmitted at once on different channels are each decoded and
+// tagged with their channel, a packet between channels is decoded once.
+func TestChannelize(t *testing.T) {
+	cfg := PacketConfig{
+		Protocol:        "ert",
+		Preamble:        scmPreamble,
+		DataRate:        32768,
+		PreambleSymbols: len(scmPreamble),
+		PacketSymbols:   96,
+	}
+
+	const centerFreq = 912000000
+
+	d := NewDecoder()
+	for _, c := range d.Channelize(3, 24) {
+		cfg.ChipLength = c.Cfg.ChipLength
+		cfg.CenterFreq = centerFreq
+		c.RegisterProtocol(bitsParser{cfg})
+	}
+	d.Allocate()
+
+	if d.decimation != 2 {
+		t.Fatalf("expected decimation 2, got %d", d.decimation)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	packet := func() string {
+		bits := []byte(cfg.Preamble)
+		for len(bits) < cfg.PacketSymbols {
+			bits = append(bits, '0'+byte(rng.Intn(2)))
+		}
+		return string(bits)
+	}
+
+	// Sum of each transmission's complex baseband samples.
+	iq := make([]complex128, 48*d.Cfg.BlockSize)
+	transmit := func(start int, offset float64, bits string) {
+		chipLength := d.Cfg.ChipLength
+		for sIdx, bit := range []byte(bits) {
+			for chip := 0; chip < 2; chip++ {
+				if (bit == '1') != (chip == 0) {
+					continue
+				}
+				for idx := 0; idx < chipLength; idx++ {
+					n := start + (sIdx*2+chip)*chipLength + idx
+					phase := 2 * math.Pi * offset * float64(n) / float64(d.Cfg.SampleRate)
+					iq[n] += complex(0.3*math.Cos(phase), 0.3*math.Sin(phase))
+				}
+			}
+		}
+	}
+
+	low, high, between := packet(), packet(), packet()
+	transmit(4*d.Cfg.BlockSize, -ChannelWidth, low)
+	transmit(4*d.Cfg.BlockSize+1000, ChannelWidth, high)
+	transmit(24*d.Cfg.BlockSize, ChannelWidth/2, between)
+
+	samples := make([]byte, len(iq)*2)
+	for idx, v := range iq {
+		samples[idx*2] = byte(127.5 + 127.5*real(v) + rng.Float64() - 0.5)
+		samples[idx*2+1] = byte(127.5 + 127.5*imag(v) + rng.Float64() - 0.5)
+	}
+
+	got := map[string][]uint32{}
+	blockBytes := d.Cfg.BlockSize * d.Cfg.SampleSize
+	for idx := 0; idx < len(samples); idx += blockBytes {
+		for msg := range d.Decode(samples[idx : idx+blockBytes]) {
+			pkt := msg.(Packet)
+			bits := pkt.Message.(bitsMessage).bits
+			got[bits] = append(got[bits], pkt.Frequency)
+		}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		bits  string
+		freqs []uint32
+	}{
+		{"low", low, []uint32{centerFreq - ChannelWidth}},
+		{"high", high, []uint32{centerFreq + ChannelWidth}},
+		{"between", between, []uint32{centerFreq, centerFreq + ChannelWidth}},
+	} {
+		freqs := got[tc.bits]
+		if len(freqs) != 1 {
+			t.Errorf("%s: expected packet decoded once, got %d times", tc.name, len(freqs))
+			continue
+		}
+		found := false
+		for _, freq := range tc.freqs {
+			found = found || freqs[0] == freq
+		}
+		if !found {
+			t.Errorf("%s: expected frequency in %d, got %d", tc.name, tc.freqs, freqs[0])
+		}
+	}
+}
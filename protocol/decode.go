@@ -19,6 +19,7 @@ package protocol
 import (
 	"log"
 	"math"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -30,10 +31,40 @@ type PacketConfig struct {
 
 	DataRate int
 
+	// Line coding of symbols, Manchester if empty.
+	Coding string
+
 	BlockSize, BlockSize2    int
 	ChipLength, SymbolLength int
 	SampleRate               int
 
+	SampleFormat string
+	SampleSize   int
+
+	// Minimum normalized correlation of the matched filter output with a
+	// preamble for it to be detected, zero requires an exact bit match.
+	PreambleThreshold float32
+
+	// Track symbol timing across each packet as well as sampling at a fixed
+	// stride from the preamble.
+	TimingRecovery bool
+
+	// Estimate and remove the DC offset and IQ imbalance of samples before
+	// demodulating them.
+	IQCorrection bool
+
+	// Blank bursts of samples shorter than a chip whose power exceeds the
+	// noise floor by this factor, zero disables.
+	Blanker float32
+
+	// Skip searching for preambles while the buffered signal holds only
+	// noise.
+	EnergyGate bool
+
+	// Subtract decoded packets from the signal to decode weaker packets
+	// colliding with them, requires a complex sample format.
+	InterferenceCancellation bool
+
 	PreambleSymbols, PacketSymbols int
 	PreambleLength, PacketLength   int
 
@@ -41,14 +72,41 @@ type PacketConfig struct {
 	CenterFreq   uint32
 }
 
-// Decoder contains buffers and radio configuration.
+// Line codings.
+const (
+	// Each symbol is a pair of chips, one on and one off, which is on first
+	// gives the bit.
+	Manchester = "manchester"
+
+	// Each symbol is a single chip, on for 1 and off for 0.
+	NRZ = "nrz"
+)
+
+// Decoder contains buffers and radio configuration. Protocols sharing a data
+// rate and line coding share a symbol clock, the decoder demodulates each
+// sample block once and passes the signal to a decoder for each clock.
 type Decoder struct {
 	Cfg PacketConfig
 	wg  *sync.WaitGroup
 
+	clocks []*Decoder
+
+	// Channels split from the band, decimated from complex samples.
+	channels   []*channel
+	decimation int
+	iq         []complex64
+
 	Signal    []float32
 	Quantized []byte
 
+	// Matched filter output quantized from, for soft preamble detection.
+	Filtered []float32
+
+	// Signal and raw samples aligned with Quantized, for measuring decoded
+	// packets.
+	history []float32
+	raw     []byte
+
 	csum  []float32
 	demod Demodulator
 
@@ -56,10 +114,24 @@ type Decoder struct {
 	preambles    map[string][]Parser
 	protocols    []string
 
+	// Parsers of the enabled protocols by preamble, all of them if nil.
+	active map[string][]Parser
+
 	pkt []byte
 
 	packed       []byte
 	sIdxA, sIdxB []int
+
+	// Index each symbol of a packet is sampled at when tracking timing.
+	symbolIdx []int
+
+	// Noise floor shared by the decoder's clocks, and the end of the last
+	// window of signal above it in the quantized buffer of a clock.
+	noise      *noiseFloor
+	lastEnergy int
+
+	// Cancels the packets a symbol clock decodes, nil if disabled.
+	canceller *canceller
 }
 
 func NewDecoder() Decoder {
@@ -73,7 +145,51 @@ func NewDecoder() Decoder {
 func (d Decoder) Log() {
 	log.Println("CenterFreq:", d.Cfg.CenterFreq)
 	log.Println("SampleRate:", d.Cfg.SampleRate)
+	log.Println("SampleFormat:", d.Cfg.SampleFormat)
+	log.Println("BlockSize:", d.Cfg.BlockSize)
+	if d.Cfg.TimingRecovery {
+		log.Println("TimingRecovery:", d.Cfg.TimingRecovery)
+	}
+	if d.Cfg.IQCorrection {
+		log.Println("IQCorrection:", d.Cfg.IQCorrection)
+	}
+	if d.Cfg.Blanker > 0 {
+		log.Println("Blanker:", d.Cfg.Blanker)
+	}
+	if d.Cfg.EnergyGate {
+		log.Println("EnergyGate:", d.Cfg.EnergyGate)
+	}
+	if d.Cfg.PreambleThreshold > 0 {
+		log.Println("PreambleThreshold:", d.Cfg.PreambleThreshold)
+	}
+	if d.Cfg.InterferenceCancellation {
+		log.Println("InterferenceCancellation:", d.Cfg.InterferenceCancellation)
+	}
+
+	for _, c := range d.clocks {
+		c.logClock()
+	}
+
+	// Every channel decodes the same protocols.
+	if len(d.channels) > 0 {
+		var freqs []string
+		for _, c := range d.channels {
+			freqs = append(freqs, strconv.FormatInt(int64(d.Cfg.CenterFreq)+int64(c.offset), 10))
+		}
+		log.Println("Channels:", strings.Join(freqs, ","))
+		log.Println("Decimation:", d.decimation)
+
+		for _, c := range d.channels[0].clocks {
+			c.logClock()
+		}
+	}
+}
+
+// Log the configuration of a symbol clock.
+func (d Decoder) logClock() {
+	log.Println("Protocols:", strings.Join(d.protocols, ","))
 	log.Println("DataRate:", d.Cfg.DataRate)
+	log.Println("Coding:", d.Cfg.Coding)
 	log.Println("ChipLength:", d.Cfg.ChipLength)
 	log.Println("PreambleSymbols:", d.Cfg.PreambleSymbols)
 	log.Println("PreambleLength:", d.Cfg.PreambleLength)
@@ -84,8 +200,6 @@ func (d Decoder) Log() {
 	for preamble := range d.preambleStrs {
 		preambles = append(preambles, preamble)
 	}
-
-	log.Println("Protocols:", strings.Join(d.protocols, ","))
 	log.Println("Preambles:", strings.Join(preambles, ","))
 }
 
@@ -98,13 +212,46 @@ func max(a, b int) int {
 
 // Using a single decoder, register protocols to pass off decoded packets to.
 func (d *Decoder) RegisterProtocol(p Parser) {
+	cfg := p.Cfg()
+	if cfg.Coding == "" {
+		cfg.Coding = Manchester
+	}
+
+	// The center frequency is simply overridden, the sample rate is chosen
+	// for the fastest data rate.
+	d.Cfg.CenterFreq = cfg.CenterFreq
+	if cfg.DataRate > d.Cfg.DataRate {
+		d.Cfg.DataRate = cfg.DataRate
+		d.Cfg.ChipLength = cfg.ChipLength
+	}
+
+	// Find the protocol's symbol clock, or add one.
+	var clock *Decoder
+	for _, c := range d.clocks {
+		if c.Cfg.DataRate == cfg.DataRate && c.Cfg.Coding == cfg.Coding {
+			clock = c
+			break
+		}
+	}
+	if clock == nil {
+		c := NewDecoder()
+		c.wg = d.wg
+		c.Cfg.DataRate = cfg.DataRate
+		c.Cfg.Coding = cfg.Coding
+
+		clock = &c
+		d.clocks = append(d.clocks, clock)
+	}
+
+	clock.register(p)
+}
+
+// Register a protocol with a symbol clock.
+func (d *Decoder) register(p Parser) {
 	// Protocols such as R900 require the use of internal decoder data for further processing.
 	p.SetDecoder(d)
 
-	// Take the largest value for each protocol. Some values are simply overridden
-	d.Cfg.CenterFreq = p.Cfg().CenterFreq
-	d.Cfg.DataRate = max(d.Cfg.DataRate, p.Cfg().DataRate)
-	d.Cfg.ChipLength = max(d.Cfg.ChipLength, p.Cfg().ChipLength)
+	// Take the largest value for each protocol.
 	d.Cfg.PreambleSymbols = max(d.Cfg.PreambleSymbols, p.Cfg().PreambleSymbols)
 	d.Cfg.PacketSymbols = max(d.Cfg.PacketSymbols, p.Cfg().PacketSymbols)
 
@@ -127,31 +274,175 @@ func (d *Decoder) RegisterProtocol(p Parser) {
 	d.protocols = append(d.protocols, p.Cfg().Protocol)
 }
 
-// Calculate lengths and allocate internal buffers.
+// Decoders of each symbol clock, including those of each channel.
+func (d *Decoder) clockDecoders() (clocks []*Decoder) {
+	clocks = append(clocks, d.clocks...)
+	for _, c := range d.channels {
+		clocks = append(clocks, c.clocks...)
+	}
+	return clocks
+}
+
+// CenterFreqs returns the protocols registered grouped by the center
+// frequency each prefers.
+func (d *Decoder) CenterFreqs() map[uint32][]string {
+	freqs := map[uint32][]string{}
+	seen := map[string]bool{}
+	for _, c := range d.clockDecoders() {
+		for _, parsers := range c.preambles {
+			for _, p := range parsers {
+				cfg := p.Cfg()
+				if !seen[cfg.Protocol] {
+					seen[cfg.Protocol] = true
+					freqs[cfg.CenterFreq] = append(freqs[cfg.CenterFreq], cfg.Protocol)
+				}
+			}
+		}
+	}
+	return freqs
+}
+
+// Enable runs only the given protocols, or all of them if nil. Preambles of
+// disabled protocols aren't searched for.
+func (d *Decoder) Enable(protocols []string) {
+	enabled := map[string]bool{}
+	for _, protocol := range protocols {
+		enabled[protocol] = true
+	}
+
+	for _, c := range d.clockDecoders() {
+		if protocols == nil {
+			c.active = nil
+			continue
+		}
+
+		c.active = map[string][]Parser{}
+		for preamble, parsers := range c.preambles {
+			for _, p := range parsers {
+				if enabled[p.Cfg().Protocol] {
+					c.active[preamble] = append(c.active[preamble], p)
+				}
+			}
+		}
+	}
+}
+
+// Calculate lengths and allocate internal buffers. Without protocols
+// registered the decoder has a single symbol clock of its own.
 func (d *Decoder) Allocate() {
-	d.Cfg.SymbolLength = d.Cfg.ChipLength << 1
-	d.Cfg.SampleRate = d.Cfg.DataRate * d.Cfg.ChipLength
+	// Select the demodulator for the configured sample format.
+	if d.Cfg.SampleFormat == "" {
+		d.Cfg.SampleFormat = "cu8"
+	}
 
-	d.Cfg.PreambleLength = d.Cfg.PreambleSymbols * d.Cfg.SymbolLength
-	d.Cfg.PacketLength = d.Cfg.PacketSymbols * d.Cfg.SymbolLength
+	var demod Demodulator
+	var err error
+	if d.Cfg.IQCorrection {
+		demod, err = NewIQCorrector(d.Cfg.SampleFormat)
+	} else {
+		demod, err = NewDemodulator(d.Cfg.SampleFormat)
+	}
+	if err != nil {
+		panic(err)
+	}
+	d.demod = demod
+	d.Cfg.SampleSize = d.demod.SampleSize()
+	d.noise = &noiseFloor{}
+
+	if _, ok := d.demod.(ComplexDemodulator); d.Cfg.InterferenceCancellation && !ok {
+		panic("interference cancellation requires a complex sample format")
+	}
+
+	if len(d.channels) > 0 {
+		d.allocateChannels()
+		return
+	}
+
+	if d.Cfg.SampleRate == 0 {
+		d.Cfg.SampleRate = d.Cfg.DataRate * d.Cfg.ChipLength
+	}
+
+	clocks := d.clocks
+	if len(clocks) == 0 {
+		clocks = []*Decoder{d}
+	}
 
-	d.Cfg.BlockSize = NextPowerOf2(d.Cfg.PreambleLength)
+	// Every clock shifts its buffers by the same block of samples, which must
+	// be long enough to hold the longest preamble.
+	var preambleLength int
+	for _, c := range clocks {
+		if c != d {
+			// Clocks slower than the sample rate was chosen for have longer
+			// chips. Chips a fraction of a sample off drift over a packet,
+			// which timing recovery follows.
+			chips := float64(d.Cfg.SampleRate) / float64(c.Cfg.DataRate)
+			c.Cfg.ChipLength = max(int(math.Round(chips)), 1)
+			if float64(c.Cfg.ChipLength) != chips {
+				log.Printf("%s: data rate %d is not a divisor of sample rate %d", strings.Join(c.protocols, ","), c.Cfg.DataRate, d.Cfg.SampleRate)
+			}
+
+			c.Cfg.CenterFreq = d.Cfg.CenterFreq
+			c.Cfg.SampleRate = d.Cfg.SampleRate
+			c.Cfg.SampleFormat = d.Cfg.SampleFormat
+			c.Cfg.SampleSize = d.Cfg.SampleSize
+			c.Cfg.PreambleThreshold = d.Cfg.PreambleThreshold
+			c.Cfg.TimingRecovery = d.Cfg.TimingRecovery
+			c.Cfg.EnergyGate = d.Cfg.EnergyGate
+			c.Cfg.InterferenceCancellation = d.Cfg.InterferenceCancellation
+			c.demod = d.demod
+			c.noise = d.noise
+		}
+
+		c.Cfg.SymbolLength = c.Cfg.ChipLength
+		if c.Cfg.Coding != NRZ {
+			c.Cfg.SymbolLength <<= 1
+		}
+
+		c.Cfg.PreambleLength = c.Cfg.PreambleSymbols * c.Cfg.SymbolLength
+		c.Cfg.PacketLength = c.Cfg.PacketSymbols * c.Cfg.SymbolLength
+		preambleLength = max(preambleLength, c.Cfg.PreambleLength)
+	}
+
+	d.Cfg.BlockSize = NextPowerOf2(preambleLength)
 	d.Cfg.BlockSize2 = d.Cfg.BlockSize << 1
 
+	for _, c := range clocks {
+		c.Cfg.BlockSize = d.Cfg.BlockSize
+		c.Cfg.BlockSize2 = d.Cfg.BlockSize2
+		c.allocate()
+		if c.Cfg.InterferenceCancellation {
+			c.allocateCanceller()
+		}
+
+		d.Cfg.BufferLength = max(d.Cfg.BufferLength, c.Cfg.BufferLength)
+	}
+
+	if len(d.clocks) > 0 {
+		d.Signal = make([]float32, d.Cfg.BlockSize)
+		if d.Cfg.Blanker > 0 {
+			d.iq = make([]complex64, d.Cfg.BlockSize)
+		}
+	}
+}
+
+// Allocate the buffers of a symbol clock.
+func (d *Decoder) allocate() {
 	d.Cfg.BufferLength = d.Cfg.PacketLength + d.Cfg.BlockSize
+	d.lastEnergy = d.Cfg.BufferLength
 
 	// Allocate necessary buffers.
 	d.Signal = make([]float32, d.Cfg.BlockSize+d.Cfg.SymbolLength)
 	d.Quantized = make([]byte, d.Cfg.BufferLength)
+	d.Filtered = make([]float32, d.Cfg.BufferLength)
+	d.history = make([]float32, d.Cfg.BufferLength+d.Cfg.SymbolLength)
+	d.raw = make([]byte, len(d.history)*d.Cfg.SampleSize)
 
 	d.csum = make([]float32, len(d.Signal)+1)
 
-	// Calculate magnitude lookup table specified by -fastmag flag.
-	d.demod = NewMagLUT()
-
 	// Signal up to the final stage is 1-bit per byte. Allocate a buffer to
 	// store packed version 8-bits per byte.
 	d.pkt = make([]byte, (d.Cfg.PacketSymbols+7)>>3)
+	d.symbolIdx = make([]int, d.Cfg.PacketSymbols)
 
 	d.sIdxA = make([]int, 0, d.Cfg.BlockSize)
 	d.sIdxB = make([]int, 0, d.Cfg.BlockSize)
@@ -159,47 +450,181 @@ func (d *Decoder) Allocate() {
 	d.packed = make([]byte, (d.Cfg.BlockSize+d.Cfg.PreambleLength+7)>>3)
 }
 
+// Discards buffered signal so that samples from before a discontinuity in
+// the input, such as a reconnect, can't be combined with samples after it.
+func (d *Decoder) Reset() {
+	clear(d.Signal)
+	clear(d.Quantized)
+	clear(d.Filtered)
+	clear(d.history)
+	clear(d.raw)
+
+	if d.noise != nil {
+		d.noise.power = 0
+	}
+	d.lastEnergy = d.Cfg.BufferLength
+	if d.canceller != nil {
+		d.canceller.reset()
+	}
+
+	for _, c := range d.clocks {
+		c.Reset()
+	}
+	for _, c := range d.channels {
+		c.Reset()
+		clear(c.mixed)
+	}
+
+	for _, parsers := range d.preambles {
+		for _, p := range parsers {
+			if r, ok := p.(Resetter); ok {
+				r.Reset()
+			}
+		}
+	}
+}
+
 // Decode accepts a sample block and returns a channel of messages.
 func (d Decoder) Decode(input []byte) chan Message {
+	if a, ok := d.demod.(Adapter); ok {
+		a.Adapt(input)
+	}
+
+	if len(d.channels) > 0 {
+		return d.decodeChannels(input)
+	}
+
+	msgCh := make(chan Message)
+
+	// Compute the magnitude of the new block once for all clocks. Impulses
+	// are blanked from the complex samples, as on each channel.
+	if d.Cfg.Blanker > 0 {
+		d.demod.(ComplexDemodulator).Complex(input, d.iq)
+		d.noise.update(d.blankComplex(d.iq, d.Signal), len(d.Signal))
+	} else {
+		d.demod.Execute(input, d.Signal)
+		if d.Cfg.EnergyGate {
+			d.noise.update(meanPower(d.Signal), len(d.Signal))
+		}
+	}
+	for _, c := range d.clocks {
+		c.decode(d.Signal, input, msgCh)
+	}
+
+	// Close the message channel when all of the parsers have finished.
+	go func() {
+		d.wg.Wait()
+		close(msgCh)
+	}()
+
+	return msgCh
+}
+
+// Decode the magnitude of a sample block at a symbol clock, sending messages
+// to msgCh.
+func (d *Decoder) decode(signal []float32, input []byte, msgCh chan Message) {
 	// Shift buffers to append new block.
 	copy(d.Signal, d.Signal[d.Cfg.BlockSize:])
 	copy(d.Quantized, d.Quantized[d.Cfg.BlockSize:])
-
-	// Compute the magnitude of the new block.
-	d.demod.Execute(input, d.Signal[d.Cfg.SymbolLength:])
+	copy(d.Filtered, d.Filtered[d.Cfg.BlockSize:])
+	copy(d.Signal[d.Cfg.SymbolLength:], signal)
 
 	// Perform matched filter on new block.
-	d.Filter(d.Signal, d.Quantized[d.Cfg.PacketLength:])
+	d.Filter(d.Signal, d.Quantized[d.Cfg.PacketLength:], d.Filtered[d.Cfg.PacketLength:])
 
-	msgCh := make(chan Message)
+	// Keep the signal each quantized sample was filtered from.
+	copy(d.history, d.history[d.Cfg.BlockSize:])
+	copy(d.history[d.Cfg.PacketLength:], d.Signal)
+
+	// Keep raw samples, the newest block follows the end of the signal carried
+	// over from the previous block.
+	ss := d.Cfg.SampleSize
+	copy(d.raw, d.raw[d.Cfg.BlockSize*ss:])
+	copy(d.raw[(d.Cfg.PacketLength+d.Cfg.SymbolLength)*ss:], input)
+
+	if d.canceller != nil {
+		d.cancel(input, msgCh)
+	}
+
+	if d.Cfg.EnergyGate && d.gated() {
+		return
+	}
+
+	preambles := d.preambles
+	if d.active != nil {
+		preambles = d.active
+	}
 
 	// For each preamble.
-	for preamble, parsers := range d.preambles {
+	for preamble, parsers := range preambles {
 		// Get a list of packets with valid preambles.
-		pkts := d.Slice(d.Search([]byte(preamble)))
+		var pkts []Data
+		if d.Cfg.PreambleThreshold > 0 {
+			pkts = d.Slice(d.SearchSoft([]byte(preamble)), []byte(preamble))
+		} else {
+			pkts = d.Slice(d.Search([]byte(preamble)), nil)
+		}
+
+		pktCh := make(chan Message)
+		pktWg := new(sync.WaitGroup)
 
 		// Increment the wait group for all the parsers we will run on these packets.
-		d.wg.Add(len(parsers))
+		pktWg.Add(len(parsers))
 
 		// For each parser, run it on the given packets.
 		for _, p := range parsers {
-			go p.Parse(pkts, msgCh, d.wg)
+			go p.Parse(pkts, pktCh, pktWg)
 		}
+
+		go func() {
+			pktWg.Wait()
+			close(pktCh)
+		}()
+
+		// Measure the signal of each packet before passing it on.
+		d.wg.Add(1)
+		go func(preambleSymbols int, pkts []Data, parsers []Parser) {
+			defer d.wg.Done()
+			for msg := range pktCh {
+				if pkt, ok := msg.(Packet); ok {
+					pkt.Signal = d.Measure(pkt.Idx, preambleSymbols)
+					d.span(&pkt, parsers)
+					if d.canceller != nil {
+						d.decoded(pkt, pkts, parsers)
+					}
+					msg = pkt
+				}
+				msgCh <- msg
+			}
+		}(len(preamble), pkts, parsers)
 	}
+}
 
-	// Close the message channel when all of the parsers have finished.
-	go func() {
-		d.wg.Wait()
-		close(msgCh)
-	}()
+// Number of symbols in packets of the protocol which parsed a message, n if
+// it isn't known.
+func protocolSymbols(pkt Packet, parsers []Parser, n int) int {
+	for _, p := range parsers {
+		if strings.EqualFold(p.Cfg().Protocol, pkt.MsgType()) {
+			return p.Cfg().PacketSymbols
+		}
+	}
+	return n
+}
 
-	return msgCh
+// Set the samples a packet spans. The newest block follows the signal carried
+// over from the previous block in the symbol clock's buffers.
+func (d *Decoder) span(pkt *Packet, parsers []Parser) {
+	pkt.Start = pkt.Idx - d.Cfg.PacketLength - d.Cfg.SymbolLength
+	pkt.Length = protocolSymbols(*pkt, parsers, d.Cfg.PacketSymbols) * d.Cfg.SymbolLength
 }
 
-// A Demodulator knows how to demodulate an array of uint8 IQ samples into an
-// array of float32 samples.
+// A Demodulator knows how to demodulate an array of interleaved IQ samples
+// into an array of float32 samples.
 type Demodulator interface {
 	Execute([]byte, []float32)
+
+	// SampleSize returns the number of bytes per complex sample.
+	SampleSize() int
 }
 
 // Default Magnitude Lookup Table
@@ -224,9 +649,24 @@ func (lut MagLUT) Execute(input []byte, output []float32) {
 	}
 }
 
+// Converts IQ samples to complex values with the same DC offset and scale as
+// the lookup table.
+func (lut MagLUT) Complex(input []byte, output []complex64) {
+	i := 0
+	for idx := range output {
+		output[idx] = complex((float32(input[i])-127.5)/127.5, (float32(input[i+1])-127.5)/127.5)
+		i += 2
+	}
+}
+
+func (lut MagLUT) SampleSize() int {
+	return 2
+}
+
 // Matched filter for Manchester coded signals. Output signal's sign at each
-// sample determines the bit-value due to Manchester symbol odd symmetry.
-func (d Decoder) Filter(input []float32, output []byte) {
+// sample determines the bit-value due to Manchester symbol odd symmetry. The
+// unquantized output is written to filtered.
+func (d Decoder) Filter(input []float32, output []byte, filtered []float32) {
 	// Computing the cumulative summation over the signal simplifies
 	// filtering to the difference of a pair of subtractions.
 	var sum float32
@@ -235,11 +675,32 @@ func (d Decoder) Filter(input []float32, output []byte) {
 		d.csum[idx+1] = sum
 	}
 
+	if d.Cfg.Coding == NRZ {
+		d.filterNRZ(input, output, filtered)
+		return
+	}
+
 	// Filter result is difference of summation of lower and upper chips.
 	lower := d.csum[d.Cfg.ChipLength:]
 	upper := d.csum[d.Cfg.SymbolLength:]
 	for idx, l := range lower[:len(output)] {
 		f := (l - d.csum[idx]) - (upper[idx] - l)
+		filtered[idx] = f
+		output[idx] = 1 - byte(math.Float32bits(f)>>31)
+	}
+}
+
+// Matched filter for NRZ coded signals. Without an off chip in each symbol to
+// compare against, chips are compared against the mean of the signal, which
+// works as long as a packet spans most of the block.
+func (d Decoder) filterNRZ(input []float32, output []byte, filtered []float32) {
+	cl := d.Cfg.ChipLength
+	threshold := d.csum[len(input)] / float32(len(input)) * float32(cl)
+
+	upper := d.csum[cl:]
+	for idx, u := range upper[:len(output)] {
+		f := u - d.csum[idx] - threshold
+		filtered[idx] = f
 		output[idx] = 1 - byte(math.Float32bits(f)>>31)
 	}
 }
@@ -253,6 +714,16 @@ func (d Decoder) Filter(input []float32, output []byte) {
 //  4. Convert indices from byte-based to sample-based.
 //  5. Check each of these indices for the preamble.
 func (d *Decoder) Search(preamble []byte) []int {
+	// Eliminating indices a byte at a time needs symbols spanning whole
+	// bytes, otherwise check every index.
+	if d.Cfg.SymbolLength&7 != 0 {
+		d.sIdxA = d.sIdxA[:0]
+		for qIdx := 0; qIdx < d.Cfg.BlockSize; qIdx++ {
+			d.sIdxA = append(d.sIdxA, qIdx)
+		}
+		return d.searchIndices(preamble)
+	}
+
 	symLenByte := d.Cfg.SymbolLength >> 3
 
 	// Pack the bit-wise quantized signal into bytes.
@@ -293,8 +764,6 @@ func (d *Decoder) Search(preamble []byte) []int {
 		}
 	}
 
-	symLen := d.Cfg.SymbolLength
-
 	// Truncate index list B.
 	d.sIdxB = d.sIdxB[:0]
 	// For each index in list A.
@@ -309,6 +778,13 @@ func (d *Decoder) Search(preamble []byte) []int {
 	// Swap index lists A and B.
 	d.sIdxA, d.sIdxB = d.sIdxB, d.sIdxA
 
+	return d.searchIndices(preamble)
+}
+
+// Check which of the candidate indices in index list A the preamble exists at.
+func (d *Decoder) searchIndices(preamble []byte) []int {
+	symLen := d.Cfg.SymbolLength
+
 	// Check which indices the preamble actually exists at.
 	for pIdx, pBit := range preamble {
 		offset := pIdx * symLen
@@ -327,6 +803,36 @@ func (d *Decoder) Search(preamble []byte) []int {
 	return d.sIdxA
 }
 
+// Return a list of indices into the quantized signal at which the matched
+// filter output correlates with the preamble at least as well as the
+// configured threshold. Correlation is normalized by the magnitude of the
+// filter output, an exact match scores 1. Bits in error with little
+// confidence reduce the score less than confident ones.
+func (d *Decoder) SearchSoft(preamble []byte) []int {
+	sl := d.Cfg.SymbolLength
+	threshold := d.Cfg.PreambleThreshold
+
+	d.sIdxA = d.sIdxA[:0]
+	for qIdx := 0; qIdx < d.Cfg.BlockSize; qIdx++ {
+		var corr, norm float32
+		for pIdx, pBit := range preamble {
+			v := d.Filtered[qIdx+pIdx*sl]
+			if pBit == 1 {
+				corr += v
+			} else {
+				corr -= v
+			}
+			norm += float32(math.Abs(float64(v)))
+		}
+
+		if norm > 0 && corr >= threshold*norm {
+			d.sIdxA = append(d.sIdxA, qIdx)
+		}
+	}
+
+	return d.sIdxA
+}
+
 func searchPassByte(pBit byte, sig []byte, a, b []int) ([]int, []int) {
 	for _, qIdx := range a {
 		if sig[qIdx] != pBit {
@@ -349,8 +855,9 @@ func searchPass(pBit byte, sig []byte, a, b []int) ([]int, []int) {
 
 // Given a list of indices the preamble exists at, sample the appropriate bits
 // of the signal's bit-decision. Pack bits of each index into an array of bytes
-// and return each packet.
-func (d Decoder) Slice(indices []int) (pkts []Data) {
+// and return each packet. If preamble is given, it replaces the first bits of
+// each packet, soft detection accepts preambles with bits in error.
+func (d Decoder) Slice(indices []int, preamble []byte) (pkts []Data) {
 	// For each of the indices the preamble exists at.
 	for _, qIdx := range indices {
 		// Check that we're still within the first sample block. We'll catch
@@ -359,21 +866,100 @@ func (d Decoder) Slice(indices []int) (pkts []Data) {
 			continue
 		}
 
-		// Packet is 1 bit per byte, pack to 8-bits per byte.
-		for pIdx := 0; pIdx < d.Cfg.PacketSymbols; pIdx++ {
-			d.pkt[pIdx>>3] <<= 1
-			d.pkt[pIdx>>3] |= d.Quantized[qIdx+(pIdx*d.Cfg.SymbolLength)]
+		// Sample each symbol at a fixed stride from the preamble.
+		for pIdx := range d.symbolIdx {
+			d.symbolIdx[pIdx] = qIdx + pIdx*d.Cfg.SymbolLength
+		}
+		pkts = append(pkts, d.pack(qIdx, preamble))
+
+		// Tracking timing keeps up with meters whose clock drifts, but noise
+		// can also lead it astray from symbols the fixed stride samples
+		// correctly. Packets it samples differently are tried as well, the
+		// parsers' checksums decide which is right.
+		if d.Cfg.TimingRecovery {
+			// The preamble was found where the fixed stride samples it.
+			d.Track(qIdx, d.symbolIdx)
+			for pIdx := 0; pIdx < d.Cfg.PreambleSymbols; pIdx++ {
+				d.symbolIdx[pIdx] = qIdx + pIdx*d.Cfg.SymbolLength
+			}
+			if data := d.pack(qIdx, preamble); data.Bits != pkts[len(pkts)-1].Bits {
+				pkts = append(pkts, data)
+			}
 		}
-
-		// Store the packet in the seen map and append to the packet list.
-		data := NewData(d.pkt)
-		data.Idx = qIdx
-		pkts = append(pkts, data)
 	}
 
 	return
 }
 
+// Pack the bits sampled at each symbol's index into a packet.
+func (d Decoder) pack(qIdx int, preamble []byte) Data {
+	// Packet is 1 bit per byte, pack to 8-bits per byte.
+	for pIdx, sIdx := range d.symbolIdx {
+		d.pkt[pIdx>>3] <<= 1
+		if pIdx < len(preamble) {
+			d.pkt[pIdx>>3] |= preamble[pIdx]
+		} else {
+			d.pkt[pIdx>>3] |= d.Quantized[sIdx]
+		}
+	}
+
+	data := NewData(d.pkt)
+	data.Idx = qIdx
+	if MaxFlips > 0 {
+		data.recoveries = &recoveries{found: map[string]recovered{}}
+	}
+	return data
+}
+
+// Gains of the timing loop. The proportional gain is the fraction of the
+// timing error corrected at each symbol, the integral gain the fraction added
+// to the estimate of the symbol clock's drift.
+const timingGain, driftGain = 0.03, 0.0005
+
+// Track finds the index of each symbol of a packet whose preamble was found at
+// qIdx using an early-late gate. The matched filter output peaks when aligned
+// with a symbol and falls off either side of it, so the difference between
+// the output a quarter chip late and a quarter chip early, signed by the
+// symbol's bit, shows which way the symbol clock has drifted.
+func (d Decoder) Track(qIdx int, symbolIdx []int) {
+	sl := d.Cfg.SymbolLength
+	delta := max(d.Cfg.ChipLength>>2, 1)
+
+	// Keep the gate within the filter output.
+	lo, hi := delta, len(d.Filtered)-sl-delta
+
+	// The filter output falls off by twice the amplitude per chip, normalize
+	// the error by the amplitude of the preamble's symbols.
+	var amplitude float64
+	for pIdx := 0; pIdx < d.Cfg.PreambleSymbols; pIdx++ {
+		amplitude += math.Abs(float64(d.Filtered[qIdx+pIdx*sl]))
+	}
+	amplitude /= float64(d.Cfg.PreambleSymbols)
+	if amplitude == 0 {
+		return
+	}
+	scale := float64(d.Cfg.ChipLength) / (4 * amplitude)
+
+	pos, drift := float64(qIdx), 0.0
+	for pIdx := range symbolIdx {
+		sIdx := int(math.Round(pos))
+		sIdx = min(max(sIdx, lo), hi)
+		symbolIdx[pIdx] = sIdx
+
+		err := float64(d.Filtered[sIdx+delta] - d.Filtered[sIdx-delta])
+		if d.Filtered[sIdx] < 0 {
+			err = -err
+		}
+
+		// Correct at most the width of the gate each symbol.
+		err = math.Max(-float64(delta), math.Min(err*scale, float64(delta)))
+		drift += driftGain * err
+		pos += timingGain*err + drift
+
+		pos += float64(sl)
+	}
+}
+
 func NextPowerOf2(v int) int {
 	return 1 << uint(math.Ceil(math.Log2(float64(v))))
 }
@@ -0,0 +1,408 @@
+package protocol
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"sync"
+	"testing"
+)
+
+const scmPreamble = "111110010101001100000"
+
+// Make a decoder for packets like SCM whose matched filter output is noise.
+func newSearchDecoder(chipLength int) Decoder {
+	d := NewDecoder()
+	d.Cfg.ChipLength = chipLength
+	d.Cfg.DataRate = 32768
+	d.Cfg.PreambleSymbols = len(scmPreamble)
+	d.Cfg.PacketSymbols = 96
+	d.Allocate()
+
+	for idx := range d.Filtered {
+		d.setFiltered(idx, float32(rand.NormFloat64()))
+	}
+
+	return d
+}
+
+func (d Decoder) setFiltered(idx int, v float32) {
+	d.Filtered[idx] = v
+	d.Quantized[idx] = 1 - byte(math.Float32bits(v)>>31)
+}
+
+// Place the preamble at idx with the given confidence in each bit, negative
+// confidence flips the bit.
+func (d Decoder) placePreamble(idx int, confidence []float32) []byte {
+	preamble := make([]byte, len(scmPreamble))
+	for pIdx, bit := range scmPreamble {
+		v := confidence[pIdx]
+		if bit == '0' {
+			v = -v
+			preamble[pIdx] = 0
+		} else {
+			preamble[pIdx] = 1
+		}
+		d.setFiltered(idx+pIdx*d.Cfg.SymbolLength, v)
+	}
+	return preamble
+}
+
+func TestSearchSoft(t *testing.T) {
+	d := newSearchDecoder(36)
+	d.Cfg.PreambleThreshold = 0.8
+
+	confidence := make([]float32, len(scmPreamble))
+	for idx := range confidence {
+		confidence[idx] = 10
+	}
+
+	// An exact preamble is found by both searches.
+	preamble := d.placePreamble(100, confidence)
+	if !slices.Contains(d.Search(preamble), 100) {
+		t.Fatal("exact search missed exact preamble")
+	}
+	if !slices.Contains(d.SearchSoft(preamble), 100) {
+		t.Fatal("soft search missed exact preamble")
+	}
+
+	// A bit in error with little confidence is only found by soft search.
+	confidence[7] = -1
+	d.placePreamble(100, confidence)
+	if slices.Contains(d.Search(preamble), 100) {
+		t.Fatal("exact search found preamble with bit in error")
+	}
+	if !slices.Contains(d.SearchSoft(preamble), 100) {
+		t.Fatal("soft search missed preamble with bit in error")
+	}
+
+	// Sliced packets carry the preamble rather than the bit in error.
+	pkts := d.Slice([]int{100}, preamble)
+	if pkts[0].Bits[:len(scmPreamble)] != scmPreamble {
+		t.Fatalf("expected preamble %s, got %s", scmPreamble, pkts[0].Bits[:len(scmPreamble)])
+	}
+}
+
+// Make a decoder for long packets, such as IDM's, at a short chip length.
+func newTrackDecoder() Decoder {
+	d := NewDecoder()
+	d.Cfg.ChipLength = 8
+	d.Cfg.DataRate = 32768
+	d.Cfg.PreambleSymbols = 64
+	d.Cfg.PacketSymbols = 736
+	d.Allocate()
+	return d
+}
+
+// Filter a random packet from a meter whose clock runs fast by the given
+// factor, in noise of the given standard deviation relative to the
+// amplitude of its chips. The packet's preamble is found at qIdx, returns
+// its bits.
+func (d Decoder) filterDrifting(rng *rand.Rand, qIdx int, clock, noise float64) string {
+	bits := make([]byte, d.Cfg.PacketSymbols)
+	for idx := range bits {
+		bits[idx] = '0' + byte(rng.Intn(2))
+	}
+
+	// Manchester encode the packet, each bit is sent as itself then its
+	// complement.
+	signal := make([]float32, len(d.Filtered)+d.Cfg.SymbolLength)
+	for idx := range signal {
+		chip := int(float64(idx-qIdx) * clock / float64(d.Cfg.ChipLength))
+		if idx >= qIdx && chip < len(bits)<<1 && bits[chip>>1]-'0' != byte(chip&1) {
+			signal[idx] = 1
+		}
+		signal[idx] += float32(rng.NormFloat64() * noise)
+	}
+	d.csum = make([]float32, len(signal)+1)
+	d.Filter(signal, d.Quantized, d.Filtered)
+
+	return string(bits)
+}
+
+// Whether any packet sliced at qIdx has the given bits.
+func (d Decoder) sliced(qIdx int, bits string) bool {
+	return slices.ContainsFunc(d.Slice([]int{qIdx}, nil), func(pkt Data) bool {
+		return pkt.Bits == bits
+	})
+}
+
+// Long packets from a meter whose clock runs fast drift out of alignment with
+// symbols sampled at a fixed stride, tracking timing keeps up with them.
+func TestTrack(t *testing.T) {
+	d := newTrackDecoder()
+
+	// The meter's clock runs fast by 0.2%, the last symbol arrives three
+	// chips early.
+	const qIdx = 64
+	bits := d.filterDrifting(rand.New(rand.NewSource(1)), qIdx, 1.002, 0.25)
+
+	if d.sliced(qIdx, bits) {
+		t.Fatal("expected symbols sampled at a fixed stride to drift")
+	}
+
+	d.Cfg.TimingRecovery = true
+	if !d.sliced(qIdx, bits) {
+		t.Fatalf("expected %s among the packets sliced", bits)
+	}
+}
+
+// Packets sliced without error out of 64, at a fixed stride and tracking
+// timing, across SNRs of the chips' amplitude to the noise and clock errors.
+// Tracking timing never loses a packet the fixed stride slices, and recovers
+// most of those whose clock drifts.
+func TestTrackSensitivity(t *testing.T) {
+	const trials, qIdx = 64, 64
+
+	for _, snr := range []float64{4, 6, 8} {
+		for _, ppm := range []float64{0, 250, 500, 1000, 2000} {
+			rng := rand.New(rand.NewSource(1))
+			d := newTrackDecoder()
+
+			var fixed, tracked int
+			for trial := 0; trial < trials; trial++ {
+				bits := d.filterDrifting(rng, qIdx, 1+ppm*1e-6, math.Pow(10, -snr/20))
+
+				d.Cfg.TimingRecovery = false
+				fixedOk := d.sliced(qIdx, bits)
+				d.Cfg.TimingRecovery = true
+				trackedOk := d.sliced(qIdx, bits)
+
+				if fixedOk && !trackedOk {
+					t.Fatalf("%.0fdB, %.0fppm: tracking lost a packet the fixed stride sliced", snr, ppm)
+				}
+				if fixedOk {
+					fixed++
+				}
+				if trackedOk {
+					tracked++
+				}
+			}
+
+			t.Logf("%.0fdB, %4.0fppm: fixed %2d, tracked %2d", snr, ppm, fixed, tracked)
+			if ppm != 0 && tracked <= fixed {
+				t.Errorf("%.0fdB, %.0fppm: expected tracking to recover packets whose clock drifts", snr, ppm)
+			}
+		}
+	}
+}
+
+// A parser sending the bits of each packet it's given.
+type bitsParser struct {
+	cfg PacketConfig
+}
+
+func (p bitsParser) Parse(pkts []Data, msgCh chan Message, wg *sync.WaitGroup) {
+	for _, pkt := range pkts {
+		msg := bitsMessage{p.cfg.Protocol, pkt.Bits[:p.cfg.PacketSymbols]}
+		msgCh <- Packet{Message: msg, Idx: pkt.Idx}
+	}
+	wg.Done()
+}
+
+func (p bitsParser) SetDecoder(*Decoder) {}
+func (p bitsParser) Cfg() PacketConfig   { return p.cfg }
+
+type bitsMessage struct {
+	protocol, bits string
+}
+
+func (msg bitsMessage) MsgType() string  { return msg.protocol }
+func (msg bitsMessage) MeterID() uint32  { return 0 }
+func (msg bitsMessage) MeterType() uint8 { return 0 }
+func (msg bitsMessage) Checksum() []byte { return nil }
+func (msg bitsMessage) Record() []string { return []string{msg.bits} }
+
+// Protocols with different data rates and line codings are decoded from the
+// same samples.
+func TestDecodeClocks(t *testing.T) {
+	fast := PacketConfig{
+		Protocol:        "fast",
+		Preamble:        scmPreamble,
+		DataRate:        32768,
+		ChipLength:      4,
+		PreambleSymbols: len(scmPreamble),
+		PacketSymbols:   48,
+	}
+	slow := PacketConfig{
+		Protocol:        "slow",
+		Preamble:        "1010101100110101",
+		DataRate:        8192,
+		Coding:          NRZ,
+		ChipLength:      4,
+		PreambleSymbols: 16,
+		PacketSymbols:   40,
+	}
+
+	d := NewDecoder()
+	d.RegisterProtocol(bitsParser{fast})
+	d.RegisterProtocol(bitsParser{slow})
+	d.Allocate()
+
+	if d.Cfg.SampleRate != 32768*4 {
+		t.Fatalf("expected sample rate for the fastest protocol, got %d", d.Cfg.SampleRate)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	packet := func(cfg PacketConfig) string {
+		bits := []byte(cfg.Preamble)
+		for len(bits) < cfg.PacketSymbols {
+			bits = append(bits, '0'+byte(rng.Intn(2)))
+		}
+		return string(bits)
+	}
+	want := map[string]string{
+		"fast": packet(fast),
+		"slow": packet(slow),
+	}
+
+	// On samples have unit magnitude, off samples none.
+	samples := make([]byte, 16*d.Cfg.BlockSize*d.Cfg.SampleSize)
+	for idx := range samples {
+		samples[idx] = 128
+	}
+	transmit := func(start int, cfg PacketConfig, bits string) {
+		chipLength := d.Cfg.SampleRate / cfg.DataRate
+		var chips []byte
+		for _, bit := range []byte(bits) {
+			if cfg.Coding == NRZ {
+				chips = append(chips, bit-'0')
+			} else {
+				chips = append(chips, bit-'0', '1'-bit)
+			}
+		}
+		for cIdx, chip := range chips {
+			for idx := 0; idx < chipLength && chip == 1; idx++ {
+				samples[(start+cIdx*chipLength+idx)*2] = 255
+			}
+		}
+	}
+	transmit(3*d.Cfg.BlockSize+100, fast, want["fast"])
+	transmit(8*d.Cfg.BlockSize+300, slow, want["slow"])
+
+	got := map[bitsMessage]bool{}
+	blockBytes := d.Cfg.BlockSize * d.Cfg.SampleSize
+	for idx := 0; idx < len(samples); idx += blockBytes {
+		for msg := range d.Decode(samples[idx : idx+blockBytes]) {
+			got[msg.(Packet).Message.(bitsMessage)] = true
+		}
+	}
+
+	for protocol, bits := range want {
+		if !got[bitsMessage{protocol, bits}] {
+			t.Errorf("%s: expected %s, got %v", protocol, bits, got)
+		}
+	}
+}
+
+// Protocols are grouped by the center frequency they prefer, and only those
+// enabled are decoded.
+func TestEnable(t *testing.T) {
+	scm := PacketConfig{
+		Protocol:        "scm",
+		CenterFreq:      912600155,
+		Preamble:        scmPreamble,
+		DataRate:        32768,
+		ChipLength:      4,
+		PreambleSymbols: len(scmPreamble),
+		PacketSymbols:   48,
+	}
+	r900 := scm
+	r900.Protocol = "r900"
+	r900.CenterFreq = 912380000
+	r900.Preamble = "11001010011100110101"
+	r900.PreambleSymbols = len(r900.Preamble)
+
+	d := NewDecoder()
+	d.RegisterProtocol(bitsParser{scm})
+	d.RegisterProtocol(bitsParser{r900})
+	d.Allocate()
+
+	freqs := d.CenterFreqs()
+	if len(freqs) != 2 || len(freqs[scm.CenterFreq]) != 1 || freqs[r900.CenterFreq][0] != "r900" {
+		t.Fatalf("expected protocols grouped by center frequency, got %v", freqs)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	packet := func(cfg PacketConfig) string {
+		bits := []byte(cfg.Preamble)
+		for len(bits) < cfg.PacketSymbols {
+			bits = append(bits, '0'+byte(rng.Intn(2)))
+		}
+		return string(bits)
+	}
+	pkts := []string{packet(scm), packet(r900)}
+
+	// On samples have unit magnitude, off samples none.
+	samples := make([]byte, 8*d.Cfg.BlockSize*d.Cfg.SampleSize)
+	for idx := range samples {
+		samples[idx] = 128
+	}
+	for pIdx, bits := range pkts {
+		start := (2+3*pIdx)*d.Cfg.BlockSize + 100
+		for sIdx, bit := range []byte(bits) {
+			chip := sIdx * 2
+			if bit == '0' {
+				chip++
+			}
+			for idx := 0; idx < scm.ChipLength; idx++ {
+				samples[(start+chip*scm.ChipLength+idx)*2] = 255
+			}
+		}
+	}
+
+	decode := func(protocols []string) (got []string) {
+		d.Enable(protocols)
+		d.Reset()
+		blockBytes := d.Cfg.BlockSize * d.Cfg.SampleSize
+		for idx := 0; idx < len(samples); idx += blockBytes {
+			for msg := range d.Decode(samples[idx : idx+blockBytes]) {
+				got = append(got, msg.(Packet).Message.(bitsMessage).protocol)
+			}
+		}
+		// Packets are found again in each block they span.
+		slices.Sort(got)
+		return slices.Compact(got)
+	}
+
+	for _, tc := range []struct {
+		protocols, want []string
+	}{
+		{[]string{"r900"}, []string{"r900"}},
+		{[]string{"scm"}, []string{"scm"}},
+		{nil, []string{"r900", "scm"}},
+	} {
+		if got := decode(tc.protocols); !slices.Equal(got, tc.want) {
+			t.Errorf("enabled %v: expected %v, got %v", tc.protocols, tc.want, got)
+		}
+	}
+}
+
+func benchmarkSearch(b *testing.B, soft bool) {
+	d := newSearchDecoder(36)
+	d.Cfg.PreambleThreshold = 0.8
+
+	preamble := make([]byte, len(scmPreamble))
+	for idx, bit := range scmPreamble {
+		preamble[idx] = byte(bit - '0')
+	}
+
+	b.SetBytes(int64(d.Cfg.BlockSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if soft {
+			d.SearchSoft(preamble)
+		} else {
+			d.Search(preamble)
+		}
+	}
+}
+
+func BenchmarkSearch(b *testing.B) {
+	benchmarkSearch(b, false)
+}
+
+func BenchmarkSearchSoft(b *testing.B) {
+	benchmarkSearch(b, true)
+}
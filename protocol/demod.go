@@ -0,0 +1,284 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Given a sample format, return a demodulator for it. Supported formats are
+// cu8 (rtl-sdr), cs8 (HackRF), cs16 (little-endian, Airspy and SDRplay) and
+// cf32 (little-endian, GNU Radio).
+func NewDemodulator(format string) (Demodulator, error) {
+	switch format {
+	case "cu8":
+		return NewMagLUT(), nil
+	case "cs8":
+		return NewMagLUTS8(), nil
+	case "cs16":
+		return MagCS16{}, nil
+	case "cf32":
+		return MagCF32{}, nil
+	}
+
+	return nil, fmt.Errorf("invalid sample format: %q", format)
+}
+
+// A ComplexDemodulator can also convert interleaved IQ samples to complex
+// values, which preserve the phase needed to estimate frequency offsets.
+type ComplexDemodulator interface {
+	Complex([]byte, []complex64)
+}
+
+// Magnitude lookup table for signed 8-bit samples.
+type MagLUTS8 []float32
+
+// Pre-computes normalized squares of signed 8-bit samples indexed by their
+// unsigned representation.
+func NewMagLUTS8() (lut MagLUTS8) {
+	lut = make([]float32, 0x100)
+	for idx := range lut {
+		lut[idx] = float32(int8(idx)) / 128
+		lut[idx] *= lut[idx]
+	}
+	return
+}
+
+// Calculates complex magnitude on given IQ stream writing result to output.
+func (lut MagLUTS8) Execute(input []byte, output []float32) {
+	i := 0
+	for idx := range output {
+		output[idx] = lut[input[i]] + lut[input[i+1]]
+		i += 2
+	}
+}
+
+func (lut MagLUTS8) Complex(input []byte, output []complex64) {
+	i := 0
+	for idx := range output {
+		output[idx] = complex(float32(int8(input[i]))/128, float32(int8(input[i+1]))/128)
+		i += 2
+	}
+}
+
+func (lut MagLUTS8) SampleSize() int {
+	return 2
+}
+
+// Magnitude of little-endian signed 16-bit samples.
+type MagCS16 struct{}
+
+// Calculates complex magnitude on given IQ stream writing result to output.
+func (MagCS16) Execute(input []byte, output []float32) {
+	i := 0
+	for idx := range output {
+		re := float32(int16(binary.LittleEndian.Uint16(input[i:]))) / 32768
+		im := float32(int16(binary.LittleEndian.Uint16(input[i+2:]))) / 32768
+		output[idx] = re*re + im*im
+		i += 4
+	}
+}
+
+func (MagCS16) Complex(input []byte, output []complex64) {
+	i := 0
+	for idx := range output {
+		re := float32(int16(binary.LittleEndian.Uint16(input[i:]))) / 32768
+		im := float32(int16(binary.LittleEndian.Uint16(input[i+2:]))) / 32768
+		output[idx] = complex(re, im)
+		i += 4
+	}
+}
+
+func (MagCS16) SampleSize() int {
+	return 4
+}
+
+// Magnitude of little-endian 32-bit float samples.
+type MagCF32 struct{}
+
+// Calculates complex magnitude on given IQ stream writing result to output.
+func (MagCF32) Execute(input []byte, output []float32) {
+	i := 0
+	for idx := range output {
+		re := math.Float32frombits(binary.LittleEndian.Uint32(input[i:]))
+		im := math.Float32frombits(binary.LittleEndian.Uint32(input[i+4:]))
+		output[idx] = re*re + im*im
+		i += 8
+	}
+}
+
+func (MagCF32) Complex(input []byte, output []complex64) {
+	i := 0
+	for idx := range output {
+		re := math.Float32frombits(binary.LittleEndian.Uint32(input[i:]))
+		im := math.Float32frombits(binary.LittleEndian.Uint32(input[i+4:]))
+		output[idx] = complex(re, im)
+		i += 8
+	}
+}
+
+func (MagCF32) SampleSize() int {
+	return 8
+}
+
+// An Adapter is a Demodulator which estimates properties of the samples it's
+// given, such as DC offset. The decoder passes each sample block to Adapt
+// once before demodulating it.
+type Adapter interface {
+	Adapt([]byte)
+}
+
+// Samples over which IQ correction estimates are averaged, about half a
+// second at the default sample rate. Packets are a few milliseconds long, so
+// their carriers barely disturb the estimates.
+const iqTimeConstant = 1 << 20
+
+// An IQCorrector removes the DC offset and IQ imbalance of samples before
+// demodulating them with the demodulator of their format. Dongles add a DC
+// spike at the center frequency, and mismatched gain and phase between their
+// I and Q paths, both of which fixed lookup tables ignore.
+//
+// Noise is circular, with no DC offset, equal power in I and Q and no
+// correlation between them. Estimates of the samples' mean and second
+// moments give the offset to subtract and the transform making the noise
+// circular again, which also undoes the imbalance for signals.
+type IQCorrector struct {
+	base interface {
+		Demodulator
+		ComplexDemodulator
+	}
+
+	initialized bool
+
+	// Estimated DC offset and second moments of the samples once it's
+	// removed.
+	dc         complex128
+	ii, qq, iq float64
+
+	// Correction, Q is replaced by (Q - cross*I) * gain.
+	cross, gain float32
+}
+
+// Wraps the demodulator of a sample format with IQ correction.
+func NewIQCorrector(format string) (*IQCorrector, error) {
+	demod, err := NewDemodulator(format)
+	if err != nil {
+		return nil, err
+	}
+
+	base, ok := demod.(interface {
+		Demodulator
+		ComplexDemodulator
+	})
+	if !ok {
+		return nil, fmt.Errorf("sample format %q doesn't provide complex samples", format)
+	}
+
+	return &IQCorrector{base: base, gain: 1}, nil
+}
+
+// Number of complex samples converted at a time, small enough for each call
+// to hold them on its own stack.
+const iqChunk = 256
+
+// Updates the estimates with a block of samples. Not safe to call
+// concurrently with itself or other methods.
+func (c *IQCorrector) Adapt(input []byte) {
+	ss := c.base.SampleSize()
+	n := len(input) / ss
+
+	// Sums of the samples and their products, from which moments about any
+	// offset follow.
+	var chunk [iqChunk]complex64
+	var sumI, sumQ, sumII, sumQQ, sumIQ float64
+	for start := 0; start < n; start += len(chunk) {
+		samples := chunk[:min(len(chunk), n-start)]
+		c.base.Complex(input[start*ss:], samples)
+		for _, v := range samples {
+			i, q := float64(real(v)), float64(imag(v))
+			sumI += i
+			sumQ += q
+			sumII += i * i
+			sumQQ += q * q
+			sumIQ += i * q
+		}
+	}
+	meanI, meanQ := sumI/float64(n), sumQ/float64(n)
+
+	alpha := math.Min(float64(n)/iqTimeConstant, 1)
+	if !c.initialized {
+		alpha = 1
+	}
+	c.dc += complex(alpha, 0) * (complex(meanI, meanQ) - c.dc)
+
+	// Second moments about the estimated DC offset.
+	dcI, dcQ := real(c.dc), imag(c.dc)
+	ii := sumII/float64(n) - 2*dcI*meanI + dcI*dcI
+	qq := sumQQ/float64(n) - 2*dcQ*meanQ + dcQ*dcQ
+	iq := sumIQ/float64(n) - dcI*meanQ - dcQ*meanI + dcI*dcQ
+	c.ii += alpha * (ii - c.ii)
+	c.qq += alpha * (qq - c.qq)
+	c.iq += alpha * (iq - c.iq)
+	c.initialized = true
+
+	// Subtracting the part of Q correlated with I leaves it orthogonal, then
+	// scaling it to the power of I balances them.
+	if c.ii <= 0 {
+		return
+	}
+	cross := c.iq / c.ii
+	residual := c.qq - cross*c.iq
+	if residual <= 0 {
+		return
+	}
+	c.cross = float32(cross)
+	c.gain = float32(math.Sqrt(c.ii / residual))
+}
+
+// Calculates the complex magnitude of corrected samples. Safe to call from
+// several goroutines between calls to Adapt.
+func (c *IQCorrector) Execute(input []byte, output []float32) {
+	ss := c.base.SampleSize()
+
+	var chunk [iqChunk]complex64
+	for start := 0; start < len(output); start += len(chunk) {
+		samples := chunk[:min(len(chunk), len(output)-start)]
+		c.Complex(input[start*ss:], samples)
+		for idx, v := range samples {
+			output[start+idx] = real(v)*real(v) + imag(v)*imag(v)
+		}
+	}
+}
+
+// Converts IQ samples to corrected complex values. Safe to call from several
+// goroutines between calls to Adapt.
+func (c *IQCorrector) Complex(input []byte, output []complex64) {
+	c.base.Complex(input, output)
+
+	dcI, dcQ := float32(real(c.dc)), float32(imag(c.dc))
+	for idx, v := range output {
+		i := real(v) - dcI
+		q := imag(v) - dcQ
+		output[idx] = complex(i, (q-c.cross*i)*c.gain)
+	}
+}
+
+func (c *IQCorrector) SampleSize() int {
+	return c.base.SampleSize()
+}
@@ -0,0 +1,210 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+// Equivalent samples in each signed format must demodulate identically.
+func TestDemodulatorFormats(t *testing.T) {
+	const n = 4096
+
+	cs8 := make([]byte, n<<1)
+	rand.Read(cs8)
+
+	cs16 := make([]byte, n<<2)
+	cf32 := make([]byte, n<<3)
+	for idx, v := range cs8 {
+		binary.LittleEndian.PutUint16(cs16[idx<<1:], uint16(int16(int8(v))<<8))
+		binary.LittleEndian.PutUint32(cf32[idx<<2:], math.Float32bits(float32(int8(v))/128))
+	}
+
+	inputs := map[string][]byte{"cs8": cs8, "cs16": cs16, "cf32": cf32}
+
+	outputs := map[string][]float32{}
+	for format, input := range inputs {
+		demod, err := NewDemodulator(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if demod.SampleSize()*n != len(input) {
+			t.Fatalf("%s: sample size %d doesn't match input", format, demod.SampleSize())
+		}
+
+		outputs[format] = make([]float32, n)
+		demod.Execute(input, outputs[format])
+	}
+
+	for format, output := range outputs {
+		for idx, v := range output {
+			if v != outputs["cs8"][idx] {
+				t.Fatalf("%s: sample %d: expected %f got %f", format, idx, outputs["cs8"][idx], v)
+			}
+		}
+	}
+}
+
+func TestDemodulatorInvalid(t *testing.T) {
+	if _, err := NewDemodulator("cu4"); err == nil {
+		t.Fatal("expected error for invalid format")
+	}
+}
+
+// Samples of circular noise, with a DC offset and the I and Q paths' gain and
+// phase mismatched, quantized to cu8.
+func impairedNoise(rng *rand.Rand, n int, sigma float64, dc complex128, gain, phase float64) []byte {
+	samples := make([]byte, n<<1)
+	for idx := 0; idx < n; idx++ {
+		i := rng.NormFloat64() * sigma
+		q := rng.NormFloat64() * sigma
+		samples[idx<<1], samples[idx<<1|1] = impair(i, q, dc, gain, phase)
+	}
+	return samples
+}
+
+// Applies a DC offset and IQ imbalance to a sample, quantized to cu8.
+func impair(i, q float64, dc complex128, gain, phase float64) (byte, byte) {
+	q = gain * (q*math.Cos(phase) + i*math.Sin(phase))
+	i += real(dc)
+	q += imag(dc)
+
+	quantize := func(v float64) byte {
+		return byte(math.Max(0, math.Min(255, math.Round(127.5+127.5*v))))
+	}
+	return quantize(i), quantize(q)
+}
+
+// Corrected noise has no DC offset and equal, uncorrelated power in I and Q.
+func TestIQCorrector(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	c, err := NewIQCorrector("cu8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const blockSize = 1 << 14
+	input := impairedNoise(rng, 64*blockSize, 0.1, complex(0.08, -0.05), 1.2, 0.15)
+	for idx := 0; idx < len(input); idx += blockSize << 1 {
+		c.Adapt(input[idx : idx+blockSize<<1])
+	}
+
+	output := make([]complex64, blockSize)
+	c.Complex(input[len(input)-blockSize<<1:], output)
+
+	var mean complex128
+	var ii, qq, iq float64
+	for _, v := range output {
+		mean += complex128(v)
+		ii += float64(real(v) * real(v))
+		qq += float64(imag(v) * imag(v))
+		iq += float64(real(v) * imag(v))
+	}
+	mean /= blockSize
+
+	if cmplx.Abs(mean) > 0.005 {
+		t.Errorf("expected no DC offset, got %.4f", mean)
+	}
+	if ratio := qq / ii; math.Abs(ratio-1) > 0.05 {
+		t.Errorf("expected balanced power, got Q/I ratio %.3f", ratio)
+	}
+	if rho := iq / math.Sqrt(ii*qq); math.Abs(rho) > 0.05 {
+		t.Errorf("expected uncorrelated I and Q, got correlation %.3f", rho)
+	}
+}
+
+// Counts packets decoded from weak transmissions received by a dongle with a
+// strong DC offset and IQ imbalance.
+func decodeImpaired(correct bool, amplitude float64, dc complex128) int {
+	cfg := PacketConfig{
+		Protocol:        "scm",
+		Preamble:        scmPreamble,
+		DataRate:        32768,
+		ChipLength:      8,
+		PreambleSymbols: len(scmPreamble),
+		PacketSymbols:   96,
+	}
+
+	d := NewDecoder()
+	d.RegisterProtocol(bitsParser{cfg})
+	d.Cfg.IQCorrection = correct
+	d.Allocate()
+
+	rng := rand.New(rand.NewSource(1))
+
+	const packets = 40
+	spacing := 4 * d.Cfg.BlockSize
+	n := (packets + 2) * spacing
+	i := make([]float64, n)
+	q := make([]float64, n)
+	for idx := range i {
+		i[idx] = rng.NormFloat64() * 0.05
+		q[idx] = rng.NormFloat64() * 0.05
+	}
+
+	want := map[string]bool{}
+	for pIdx := 0; pIdx < packets; pIdx++ {
+		bits := []byte(cfg.Preamble)
+		for len(bits) < cfg.PacketSymbols {
+			bits = append(bits, '0'+byte(rng.Intn(2)))
+		}
+		want[string(bits)] = true
+
+		// Carriers a few kHz from the center frequency, with random phase.
+		start := (pIdx+1)*spacing + rng.Intn(d.Cfg.BlockSize)
+		freq := 2 * math.Pi * (rng.Float64()*10e3 - 5e3) / float64(d.Cfg.SampleRate)
+		phase := rng.Float64() * 2 * math.Pi
+		for sIdx, bit := range bits {
+			chip := sIdx * 2
+			if bit == '0' {
+				chip++
+			}
+			for idx := chip * cfg.ChipLength; idx < (chip+1)*cfg.ChipLength; idx++ {
+				theta := phase + freq*float64(idx)
+				i[start+idx] += amplitude * math.Cos(theta)
+				q[start+idx] += amplitude * math.Sin(theta)
+			}
+		}
+	}
+
+	samples := make([]byte, n<<1)
+	for idx := range i {
+		samples[idx<<1], samples[idx<<1|1] = impair(i[idx], q[idx], dc, 1.2, 0.15)
+	}
+
+	found := map[string]bool{}
+	blockBytes := d.Cfg.BlockSize * d.Cfg.SampleSize
+	for idx := 0; idx+blockBytes <= len(samples); idx += blockBytes {
+		for msg := range d.Decode(samples[idx : idx+blockBytes]) {
+			bits := msg.(Packet).Message.(bitsMessage).bits
+			if want[bits] {
+				found[bits] = true
+			}
+		}
+	}
+
+	return len(found)
+}
+
+// Correction recovers packets a DC offset and IQ imbalance hide.
+func TestIQCorrectorSensitivity(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		amplitude float64
+		dc        complex128
+	}{
+		{"imbalance", 0.1, 0},
+		{"dc", 0.1, complex(0.1, -0.07)},
+		{"strong dc", 0.2, complex(0.2, -0.15)},
+	} {
+		plain := decodeImpaired(false, tc.amplitude, tc.dc)
+		corrected := decodeImpaired(true, tc.amplitude, tc.dc)
+		if corrected < plain+5 {
+			t.Errorf("%s: expected more packets with correction, got %d without and %d with", tc.name, plain, corrected)
+		}
+	}
+}
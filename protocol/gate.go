@@ -0,0 +1,199 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import "math"
+
+// Weight of each block in the noise floor estimate.
+const floorAlpha = 0.05
+
+// Window power, in standard deviations of noise above the noise floor, which
+// opens the energy gate. Low enough that preambles too weak to decode still
+// open it.
+const gateSigma = 4
+
+// Noise floor estimated from the signal power of each block, shared by a
+// decoder's symbol clocks, and counts of what the blanker and gate did with
+// it.
+type noiseFloor struct {
+	power float32 // Mean signal power of noise, zero until estimated.
+
+	blanked         int // Samples blanked.
+	blocks, skipped int // Blocks decoded, and those whose search was skipped.
+}
+
+// Update the noise floor with the mean signal power of a block of length
+// samples. Only noise is wanted, so blocks are counted as no more than
+// gateSigma standard deviations of noise above the estimate, and long packets
+// spanning many blocks barely raise it. Noise rising further is followed over
+// hundreds of blocks, falling over tens.
+func (n *noiseFloor) update(mean float32, length int) {
+	if n.power == 0 {
+		n.power = mean
+		return
+	}
+
+	limit := n.power * (1 + gateSigma/float32(math.Sqrt(float64(length))))
+	n.power += floorAlpha * (min(mean, limit) - n.power)
+}
+
+// Mean of a block of signal power.
+func meanPower(signal []float32) float32 {
+	var sum float32
+	for _, v := range signal {
+		sum += v
+	}
+	return sum / float32(len(signal))
+}
+
+// Find bursts of samples whose power exceeds threshold times the noise floor
+// for no longer than maxLength samples, too short to be chips. Noise breaks
+// chips of weaker signals into short bursts too, but unlike impulses they
+// adjoin signal on at least one side, so bursts are impulses only if the
+// maxLength samples on each side average well below the threshold, or below
+// the burst's peak by the threshold for impulses on top of signals. Calls
+// blank with the bounds of each impulse, widened by a sample either side for
+// its edges.
+func (n *noiseFloor) impulses(power []float32, threshold float32, maxLength int, blank func(start, end int)) {
+	if n.power == 0 {
+		return
+	}
+
+	level := threshold * n.power
+
+	// Halfway between the noise floor and the threshold in dB.
+	isolated := float32(math.Sqrt(float64(threshold))) * n.power
+
+	start := -1
+	var peak float32
+	for idx := 0; idx <= len(power); idx++ {
+		if idx < len(power) && power[idx] > level {
+			if start < 0 {
+				start, peak = idx, 0
+			}
+			if power[idx] > peak {
+				peak = power[idx]
+			}
+			continue
+		}
+		if start < 0 {
+			continue
+		}
+
+		if idx-start <= maxLength && surrounding(power, start, idx, maxLength, level) < max32(isolated, peak/threshold) {
+			lower, upper := max(start-1, 0), min(idx+1, len(power))
+			blank(lower, upper)
+			n.blanked += upper - lower
+		}
+		start = -1
+	}
+}
+
+// The greater mean power of up to width samples before and after a burst.
+// Samples are limited to level, so that other impulses nearby count for
+// little.
+func surrounding(power []float32, start, end, width int, level float32) float32 {
+	side := func(power []float32) float32 {
+		if len(power) == 0 {
+			return 0
+		}
+		var sum float32
+		for _, p := range power {
+			sum += min(p, level)
+		}
+		return sum / float32(len(power))
+	}
+
+	return max32(side(power[max(start-width, 0):start]), side(power[end:min(end+width, len(power))]))
+}
+
+// Blank impulses in a block of complex samples, zeroing them, and write the
+// power of the block to power, impulses replaced with the noise floor. Holes
+// in the magnitude would bias the matched filter against chips they fall in.
+// Returns the mean power of the block once blanked.
+func (d Decoder) blankComplex(iq []complex64, power []float32) float32 {
+	for idx, v := range iq {
+		power[idx] = real(v)*real(v) + imag(v)*imag(v)
+	}
+
+	d.noise.impulses(power, d.Cfg.Blanker, max(d.Cfg.ChipLength>>1, 1), func(start, end int) {
+		clear(iq[start:end])
+		for idx := start; idx < end; idx++ {
+			power[idx] = d.noise.power
+		}
+	})
+
+	return meanPower(power)
+}
+
+// Update the energy gate of a symbol clock with the signal of the newest
+// block, the matched filter having computed its cumulative sum. Reports
+// whether the buffer holds only noise, so no preamble can be found in it.
+//
+// Preambles are detected by the energy of windows half their length, one of
+// which fits within a single block however a preamble straddles blocks.
+// Averaged over so many samples the power of noise barely varies, a window a
+// few standard deviations above the noise floor holds a signal, even one too
+// weak to decode.
+func (d *Decoder) gated() bool {
+	d.noise.blocks++
+
+	// The end of the last window holding a signal, relative to the start of
+	// the quantized buffer.
+	d.lastEnergy -= d.Cfg.BlockSize
+
+	window := max(d.Cfg.PreambleLength>>1, 1)
+	threshold := d.noise.power * float32(window) * (1 + gateSigma/float32(math.Sqrt(float64(window))))
+
+	signal := d.csum[:len(d.Signal)+1]
+	for idx := len(signal) - 1 - window; idx >= 0; idx-- {
+		if signal[idx+window]-signal[idx] > threshold {
+			d.lastEnergy = d.Cfg.PacketLength + idx + window
+			break
+		}
+	}
+
+	// Packets are searched for at the start of the buffer, allowing for the
+	// matched filter spanning a symbol.
+	if d.lastEnergy+d.Cfg.SymbolLength < 0 {
+		d.noise.skipped++
+		return true
+	}
+
+	return false
+}
+
+// GateStats returns the number of samples blanked, and the number of blocks
+// decoded by each symbol clock and how many of them the energy gate skipped
+// searching.
+func (d *Decoder) GateStats() (blanked, blocks, skipped int) {
+	if d.noise != nil {
+		blanked, blocks, skipped = d.noise.blanked, d.noise.blocks, d.noise.skipped
+	}
+	for _, c := range d.channels {
+		b, n, s := c.GateStats()
+		blanked, blocks, skipped = blanked+b, blocks+n, skipped+s
+	}
+	return blanked, blocks, skipped
+}
+
+func max32(a, b float32) float32 {
+	if a > b {
+		return a
+	}
+	return b
+}
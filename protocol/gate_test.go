@@ -0,0 +1,169 @@
+package protocol
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Impulses are blanked, bursts from chips of weak signals aren't.
+func TestImpulses(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	const maxLength = 4
+	power := make([]float32, 4096)
+	for idx := range power {
+		power[idx] = float32(rng.ExpFloat64())
+	}
+
+	// Isolated impulses, and a pair close together.
+	impulses := []int{500, 1500, 1510, 3000}
+	for _, idx := range impulses {
+		power[idx], power[idx+1] = 1000, 1000
+	}
+
+	// A chip a little stronger than the threshold, noise breaking it into
+	// short bursts.
+	for idx := 2000; idx < 2016; idx++ {
+		power[idx] = float32(20 * rng.ExpFloat64())
+	}
+
+	n := &noiseFloor{power: 1}
+	blanked := map[int]bool{}
+	n.impulses(power, 10, maxLength, func(start, end int) {
+		for idx := start; idx < end; idx++ {
+			blanked[idx] = true
+		}
+	})
+
+	for _, idx := range impulses {
+		if !blanked[idx] || !blanked[idx+1] {
+			t.Errorf("expected impulse at %d blanked", idx)
+		}
+	}
+	for idx := 2000; idx < 2016; idx++ {
+		if blanked[idx] {
+			t.Errorf("expected chip sample %d kept", idx)
+		}
+	}
+	if n.blanked > len(impulses)*4+8 {
+		t.Errorf("expected little noise blanked, got %d samples", n.blanked)
+	}
+}
+
+// Decodes weak packets among impulses every impulseSpacing samples on average,
+// none if zero, and between long stretches of noise. Returns the number of
+// packets found and the decoder's gate statistics.
+func decodeGated(blanker float32, gate bool, impulseSpacing int) (found, skipped, blocks int) {
+	cfg := PacketConfig{
+		Protocol:        "scm",
+		Preamble:        scmPreamble,
+		DataRate:        32768,
+		ChipLength:      8,
+		PreambleSymbols: len(scmPreamble),
+		PacketSymbols:   96,
+	}
+
+	d := NewDecoder()
+	d.RegisterProtocol(bitsParser{cfg})
+	d.Cfg.Blanker = blanker
+	d.Cfg.EnergyGate = gate
+	d.Allocate()
+
+	rng := rand.New(rand.NewSource(1))
+
+	const packets = 20
+	spacing := 32 * d.Cfg.BlockSize
+	n := (packets + 2) * spacing
+	i := make([]float64, n)
+	q := make([]float64, n)
+	for idx := range i {
+		i[idx] = rng.NormFloat64() * 0.05
+		q[idx] = rng.NormFloat64() * 0.05
+	}
+
+	// Two sample impulses at full scale, with random phase.
+	for count := 0; impulseSpacing > 0 && count < n/impulseSpacing; count++ {
+		idx := rng.Intn(n - 1)
+		phase := rng.Float64() * 2 * math.Pi
+		for _, sIdx := range []int{idx, idx + 1} {
+			i[sIdx] += math.Cos(phase)
+			q[sIdx] += math.Sin(phase)
+		}
+	}
+
+	want := map[string]bool{}
+	for pIdx := 0; pIdx < packets; pIdx++ {
+		bits := []byte(cfg.Preamble)
+		for len(bits) < cfg.PacketSymbols {
+			bits = append(bits, '0'+byte(rng.Intn(2)))
+		}
+		want[string(bits)] = true
+
+		start := (pIdx+1)*spacing + rng.Intn(d.Cfg.BlockSize)
+		phase := rng.Float64() * 2 * math.Pi
+		for sIdx, bit := range bits {
+			chip := sIdx * 2
+			if bit == '0' {
+				chip++
+			}
+			for idx := chip * cfg.ChipLength; idx < (chip+1)*cfg.ChipLength; idx++ {
+				i[start+idx] += 0.15 * math.Cos(phase)
+				q[start+idx] += 0.15 * math.Sin(phase)
+			}
+		}
+	}
+
+	samples := make([]byte, n<<1)
+	for idx := range i {
+		samples[idx<<1], samples[idx<<1|1] = impair(i[idx], q[idx], 0, 1, 0)
+	}
+
+	results := map[string]bool{}
+	blockBytes := d.Cfg.BlockSize * d.Cfg.SampleSize
+	for idx := 0; idx+blockBytes <= len(samples); idx += blockBytes {
+		for msg := range d.Decode(samples[idx : idx+blockBytes]) {
+			bits := msg.(Packet).Message.(bitsMessage).bits
+			if want[bits] {
+				results[bits] = true
+			}
+		}
+	}
+
+	_, blocks, skipped = d.GateStats()
+	return len(results), skipped, blocks
+}
+
+// The blanker recovers packets impulses destroy, and neither it nor the gate
+// loses packets the plain decoder finds.
+func TestBlanker(t *testing.T) {
+	plain, _, _ := decodeGated(0, false, 0)
+	if plain < 18 {
+		t.Fatalf("expected most packets decoded, got %d", plain)
+	}
+
+	blanked, _, _ := decodeGated(10, false, 0)
+	if blanked < plain {
+		t.Errorf("expected blanking to keep %d packets without impulses, got %d", plain, blanked)
+	}
+
+	const spacing = 100
+	noisy, _, _ := decodeGated(0, false, spacing)
+	recovered, _, _ := decodeGated(10, false, spacing)
+	if recovered < plain*4/5 || recovered < noisy+5 {
+		t.Errorf("expected blanking to recover packets, got %d of %d among impulses, %d blanked", noisy, plain, recovered)
+	}
+}
+
+func TestEnergyGate(t *testing.T) {
+	plain, _, _ := decodeGated(0, false, 0)
+	gated, skipped, blocks := decodeGated(0, true, 0)
+	if gated < plain {
+		t.Errorf("expected gate to keep %d packets, got %d", plain, gated)
+	}
+
+	// Packets span a few of the 32 blocks between them.
+	if skipped < blocks*3/4 {
+		t.Errorf("expected most blocks skipped, got %d of %d", skipped, blocks)
+	}
+}
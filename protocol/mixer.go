@@ -0,0 +1,47 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// A Mixer shifts a stream of complex samples up in frequency, such as to
+// undo tuning the receiver away from the signals of interest.
+type Mixer struct {
+	rot, phase complex128
+}
+
+// Make a new mixer shifting samples at sampleRate up by shift Hz.
+func NewMixer(shift float64, sampleRate int) *Mixer {
+	return &Mixer{
+		rot:   cmplx.Exp(complex(0, 2*math.Pi*shift/float64(sampleRate))),
+		phase: 1,
+	}
+}
+
+// Mix a block of samples in place.
+func (m *Mixer) Mix(iq []complex64) {
+	for idx, v := range iq {
+		iq[idx] = v * complex64(m.phase)
+		m.phase *= m.rot
+	}
+
+	// Keep rounding errors from changing the oscillator's amplitude.
+	m.phase /= complex(cmplx.Abs(m.phase), 0)
+}
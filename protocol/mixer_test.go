@@ -0,0 +1,22 @@
+package protocol
+
+import (
+	"math/cmplx"
+	"testing"
+)
+
+// Mixing a tone up by its own offset leaves a constant, across blocks.
+func TestMixer(t *testing.T) {
+	m := NewMixer(300e3, 2359296)
+	in := tone(-300e3, 2359296, 1<<16)
+
+	for start := 0; start < len(in); start += 1000 {
+		m.Mix(in[start:min(start+1000, len(in))])
+	}
+
+	for idx, v := range in {
+		if err := cmplx.Abs(complex128(v) - 1); err > 1e-3 {
+			t.Fatalf("expected mixed sample %d to be 1, got %v", idx, v)
+		}
+	}
+}
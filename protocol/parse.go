@@ -56,6 +56,10 @@ type Data struct {
 	Idx   int
 	Bits  string
 	Bytes []byte
+
+	// Recoveries of the packet, shared by the parsers of its preamble. Nil
+	// if recovery is disabled.
+	recoveries *recoveries
 }
 
 func NewData(data []byte) (d Data) {
@@ -68,6 +72,41 @@ func NewData(data []byte) (d Data) {
 	return
 }
 
+// ParseData runs a parser on a single packet, returning the first message it
+// parsed if any.
+func ParseData(p Parser, data Data) (pkt Packet, ok bool) {
+	msgCh := make(chan Message)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		p.Parse([]Data{data}, msgCh, wg)
+		close(msgCh)
+	}()
+
+	msg, ok := <-msgCh
+	for range msgCh {
+	}
+	if !ok {
+		return pkt, false
+	}
+
+	pkt, ok = msg.(Packet)
+	return pkt, ok
+}
+
+// Given a string of ascii 0's and 1's, pack them into bytes most significant
+// bit first. The last byte is padded with zeros.
+func PackBits(bits string) []byte {
+	data := make([]byte, (len(bits)+7)>>3)
+	for idx, bit := range bits {
+		if bit == '1' {
+			data[idx>>3] |= 0x80 >> uint(idx&7)
+		}
+	}
+
+	return data
+}
+
 // A Parser converts slices of bytes to messages.
 type Parser interface {
 	Parse([]Data, chan Message, *sync.WaitGroup)
@@ -75,6 +114,12 @@ type Parser interface {
 	Cfg() PacketConfig
 }
 
+// A Resetter is a Parser which keeps its own buffers between sample blocks
+// and can discard them when the decoder is reset.
+type Resetter interface {
+	Reset()
+}
+
 type Message interface {
 	csv.Recorder
 	MsgType() string
@@ -100,31 +145,70 @@ func NewDigest(msg Message) Digest {
 	}
 }
 
-// A LogMessage associates a message with a point in time and an offset and
-// length into a binary sample file.
+// A LogMessage associates a message with a point in time, an offset and
+// length into a binary sample file, the strength of its signal and the number
+// of bit errors corrected to decode it.
 type LogMessage struct {
-	Time   time.Time `xml:",attr"`
-	Offset int64     `xml:",attr"`
-	Length int       `xml:",attr"`
-	Type   string    `xml:",attr"`
+	Time      time.Time `xml:",attr"`
+	Offset    int64     `xml:",attr"`
+	Length    int       `xml:",attr"`
+	Type      string    `xml:",attr"`
+	Receiver  string    `xml:",attr,omitempty" json:",omitempty"` // Comma-separated names of receivers which heard the message.
+	Corrected int       `xml:",attr,omitempty" json:",omitempty"`
+	Frequency uint32    `xml:",attr,omitempty" json:",omitempty"` // Frequency of the channel the message was heard on.
+	Signal
 	Message
 }
 
 func (msg LogMessage) String() string {
-	return fmt.Sprintf("{Time:%s Offset:%d Length:%d %s:%s}",
-		msg.Time.Format(TimeFormat), msg.Offset, msg.Length, msg.MsgType(), msg.Message,
+	return fmt.Sprintf("{Time:%s Offset:%d Length:%d %s %s%s:%s}",
+		msg.Time.Format(TimeFormat), msg.Offset, msg.Length, msg.Signal, msg.receiverString()+msg.frequencyString()+msg.correctedString(), msg.MsgType(), msg.Message,
 	)
 }
 
 func (msg LogMessage) StringNoOffset() string {
-	return fmt.Sprintf("{Time:%s %s:%s}", msg.Time.Format(TimeFormat), msg.MsgType(), msg.Message)
+	return fmt.Sprintf("{Time:%s %s %s%s:%s}", msg.Time.Format(TimeFormat), msg.Signal, msg.receiverString()+msg.frequencyString()+msg.correctedString(), msg.MsgType(), msg.Message)
+}
+
+func (msg LogMessage) correctedString() string {
+	if msg.Corrected == 0 {
+		return ""
+	}
+	return "Corrected:" + strconv.Itoa(msg.Corrected) + " "
+}
+
+func (msg LogMessage) frequencyString() string {
+	if msg.Frequency == 0 {
+		return ""
+	}
+	return "Frequency:" + strconv.FormatUint(uint64(msg.Frequency), 10) + " "
+}
+
+func (msg LogMessage) receiverString() string {
+	if msg.Receiver == "" {
+		return ""
+	}
+	return "Receiver:" + msg.Receiver + " "
 }
 
 func (msg LogMessage) Record() (r []string) {
 	r = append(r, msg.Time.Format(time.RFC3339Nano))
 	r = append(r, strconv.FormatInt(msg.Offset, 10))
 	r = append(r, strconv.FormatInt(int64(msg.Length), 10))
+	r = append(r, strconv.FormatFloat(msg.RSSI, 'f', 1, 64))
+	r = append(r, strconv.FormatFloat(msg.Noise, 'f', 1, 64))
+	r = append(r, strconv.FormatFloat(msg.SNR, 'f', 1, 64))
+	r = append(r, strconv.FormatFloat(msg.FreqOffset, 'f', 0, 64))
+	r = append(r, strconv.Itoa(msg.Corrected))
 	r = append(r, msg.Message.Record()...)
+
+	// Always written, empty if unknown, so each message type's columns stay
+	// in the same place whatever the configuration.
+	frequency := ""
+	if msg.Frequency != 0 {
+		frequency = strconv.FormatUint(uint64(msg.Frequency), 10)
+	}
+	r = append(r, frequency, msg.Receiver)
 	return r
 }
 
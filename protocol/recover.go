@@ -0,0 +1,237 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/bemasher/rtlamr/crc"
+)
+
+var (
+	// Maximum number of bits flipped to recover a packet failing its
+	// checksum, zero disables recovery.
+	MaxFlips int
+
+	// Maximum number of error patterns tried for each packet. Each pattern
+	// tried accepts a corrupt packet with a probability of about 2^-16.
+	FlipLimit = 256
+)
+
+// A Recovery flips the least confident bits of packets failing their
+// checksum in search of low weight error patterns which make it pass.
+type Recovery struct {
+	crc.CRC
+
+	// Bytes of the packet covered by the checksum, including it.
+	lo, hi int
+
+	packetSymbols int
+	syndromes     []uint16
+}
+
+// Make a new recovery for packets of packetSymbols bits whose bytes lo
+// through hi are covered by the checksum. Returns nil if recovery is
+// disabled.
+func NewRecovery(c crc.CRC, packetSymbols, lo, hi int) *Recovery {
+	if MaxFlips <= 0 {
+		return nil
+	}
+
+	return &Recovery{
+		CRC:           c,
+		lo:            lo,
+		hi:            hi,
+		packetSymbols: packetSymbols,
+		syndromes:     c.BitSyndromes(hi - lo),
+	}
+}
+
+// A packet recovered by flipping bits.
+type recovered struct {
+	Data
+	flips int
+	cost  float32
+}
+
+// Packets recovered from a damaged packet, keyed by the checksum and bytes
+// recovery covered. Protocols sharing a preamble and checksum, such as IDM
+// and NetIDM, then search each packet for error patterns once. Flips of 0
+// record a packet that couldn't be recovered.
+type recoveries struct {
+	sync.Mutex
+	found map[string]recovered
+}
+
+// Recover damaged packets, fewest bits flipped first, passing each to accept
+// along with the number of bits flipped. Accept reports whether the packet
+// was accepted. Misaligned copies of a packet can often be recovered into
+// garbage, so packets overlapping the index of an accepted packet are
+// skipped. Indices of packets accepted before recovery are given by accepted.
+func (r *Recovery) Recover(d *Decoder, damaged []Data, accepted []int, accept func(Data, int) bool) {
+	if r == nil || len(damaged) == 0 {
+		return
+	}
+
+	var candidates []recovered
+	for _, pkt := range damaged {
+		if c, ok := r.cached(d, pkt); ok {
+			candidates = append(candidates, c)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].flips != candidates[j].flips {
+			return candidates[i].flips < candidates[j].flips
+		}
+		return candidates[i].cost < candidates[j].cost
+	})
+
+	packetLength := r.packetSymbols * d.Cfg.SymbolLength
+	for _, c := range candidates {
+		overlaps := slices.ContainsFunc(accepted, func(idx int) bool {
+			return abs(c.Idx-idx) < packetLength
+		})
+		if overlaps {
+			continue
+		}
+
+		if accept(c.Data, c.flips) {
+			accepted = append(accepted, c.Idx)
+		}
+	}
+}
+
+// Recover a packet, unless a parser sharing its preamble already has.
+func (r *Recovery) cached(d *Decoder, pkt Data) (c recovered, ok bool) {
+	if pkt.recoveries == nil {
+		return r.recover(d, pkt)
+	}
+
+	pkt.recoveries.Lock()
+	defer pkt.recoveries.Unlock()
+
+	key := fmt.Sprintf("%s %d %d %d", r.Name, r.lo, r.hi, r.packetSymbols)
+	if c, seen := pkt.recoveries.found[key]; seen {
+		return c, c.flips > 0
+	}
+
+	c, ok = r.recover(d, pkt)
+	pkt.recoveries.found[key] = c
+	return c, ok
+}
+
+// Search for the most likely error pattern among the least confident bits
+// of a packet which makes its checksum pass.
+func (r *Recovery) recover(d *Decoder, pkt Data) (c recovered, ok bool) {
+	syndrome := r.Syndrome(pkt.Bytes[r.lo:r.hi])
+	if syndrome == 0 {
+		return c, false
+	}
+
+	confidence := d.Confidence(pkt.Idx, r.lo<<3, len(r.syndromes))
+
+	// Consider as many of the least confident bits as the limit on patterns
+	// allows.
+	bits := make([]int, len(confidence))
+	for idx := range bits {
+		bits[idx] = idx
+	}
+	sort.Slice(bits, func(i, j int) bool {
+		return confidence[bits[i]] < confidence[bits[j]]
+	})
+	bits = bits[:candidateBits(len(bits), MaxFlips, FlipLimit)]
+
+	best := math.Inf(1)
+	var pattern []int
+
+	var search func(start int, syndrome uint16, cost float64, flipped []int)
+	search = func(start int, syndrome uint16, cost float64, flipped []int) {
+		if syndrome == 0 && len(flipped) > 0 {
+			if cost < best {
+				best = cost
+				pattern = append(pattern[:0], flipped...)
+			}
+			return
+		}
+		if len(flipped) == MaxFlips {
+			return
+		}
+		for idx := start; idx < len(bits); idx++ {
+			bIdx := bits[idx]
+			search(idx+1, syndrome^r.syndromes[bIdx], cost+float64(confidence[bIdx]), append(flipped, bIdx))
+		}
+	}
+	search(0, syndrome, 0, nil)
+
+	if pattern == nil {
+		return c, false
+	}
+
+	c.Data = NewData(pkt.Bytes[:r.packetSymbols>>3])
+	c.Idx = pkt.Idx
+	for _, bIdx := range pattern {
+		c.Bytes[r.lo+bIdx>>3] ^= 0x80 >> uint(bIdx&7)
+	}
+	c.Bits = NewData(c.Bytes).Bits
+	c.flips = len(pattern)
+	c.cost = float32(best)
+
+	return c, true
+}
+
+// Returns the number of bits, at most n, whose combinations of up to
+// maxFlips bits number no more than limit.
+func candidateBits(n, maxFlips, limit int) (k int) {
+	for k < n {
+		patterns, choose := 0, 1
+		for flips := 1; flips <= maxFlips; flips++ {
+			choose = choose * (k + 2 - flips) / flips
+			patterns += choose
+		}
+		if patterns > limit {
+			break
+		}
+		k++
+	}
+	return k
+}
+
+// Confidence returns the magnitude of the matched filter output for n
+// symbols of a packet found at idx, starting from symbol offset, whichever
+// line coding they use. Bits with the least confidence are the most likely to
+// be in error.
+func (d *Decoder) Confidence(idx, offset, n int) []float32 {
+	confidence := make([]float32, n)
+	for sym := range confidence {
+		f := d.Filtered[idx+(offset+sym)*d.Cfg.SymbolLength]
+		confidence[sym] = float32(math.Abs(float64(f)))
+	}
+
+	return confidence
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
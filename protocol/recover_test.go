@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/bemasher/rtlamr/crc"
+)
+
+func TestCandidateBits(t *testing.T) {
+	for _, tc := range []struct {
+		n, maxFlips, limit, k int
+	}{
+		{704, 1, 256, 256},
+		{704, 2, 256, 22}, // 22 + 231 patterns
+		{704, 3, 256, 11}, // 11 + 55 + 165 patterns
+		{16, 1, 256, 16},
+		{704, 2, 0, 0},
+	} {
+		if k := candidateBits(tc.n, tc.maxFlips, tc.limit); k != tc.k {
+			t.Errorf("%+v: got %d", tc, k)
+		}
+	}
+}
+
+// Bits received in error with low confidence are flipped back, whichever
+// line coding they use.
+func TestRecover(t *testing.T) {
+	for _, coding := range []string{Manchester, NRZ} {
+		t.Run(coding, func(t *testing.T) {
+			testRecover(t, coding)
+		})
+	}
+}
+
+func testRecover(t *testing.T, coding string) {
+	defer func(maxFlips int) { MaxFlips = maxFlips }(MaxFlips)
+	MaxFlips = 2
+
+	ccitt := crc.NewCRC("CCITT", 0xFFFF, 0x1021, 0x1D0F)
+	const packetSymbols = 16 * 8
+
+	d := NewDecoder()
+	d.Cfg.Coding = coding
+	d.Cfg.ChipLength = 4
+	d.Cfg.SymbolLength = 8
+	if coding == NRZ {
+		d.Cfg.ChipLength = 8
+	}
+	d.history = make([]float32, (packetSymbols+1)*d.Cfg.SymbolLength)
+	d.csum = make([]float32, len(d.history)+1)
+	d.Quantized = make([]byte, packetSymbols*d.Cfg.SymbolLength)
+	d.Filtered = make([]float32, len(d.Quantized))
+
+	r := NewRecovery(ccitt, packetSymbols, 2, 16)
+
+	for trial := 0; trial < 256; trial++ {
+		data := make([]byte, 16)
+		rand.Read(data[:14])
+		binary.BigEndian.PutUint16(data[14:], ^ccitt.Checksum(data[2:14]))
+
+		received := append([]byte(nil), data...)
+		flips := rand.Intn(MaxFlips) + 1
+		for _, bIdx := range rand.Perm(14 * 8)[:flips] {
+			received[2+bIdx>>3] ^= 0x80 >> uint(bIdx&7)
+		}
+
+		// Bits in error are received with low confidence, near the decision
+		// threshold.
+		for sym := 0; sym < packetSymbols; sym++ {
+			bit := received[sym>>3] >> uint(7-sym&7) & 1
+			level := float32(1)
+			if bit != data[sym>>3]>>uint(7-sym&7)&1 {
+				level = 0.1
+			}
+
+			symbol := d.history[sym*8 : sym*8+8]
+			if coding == NRZ {
+				level = float32(bit)
+				if bit != data[sym>>3]>>uint(7-sym&7)&1 {
+					level = 0.45 + 0.1*float32(bit)
+				}
+				for idx := range symbol {
+					symbol[idx] = level
+				}
+				continue
+			}
+
+			on, off := symbol[:4], symbol[4:]
+			if bit == 0 {
+				on, off = off, on
+			}
+			for idx := range on {
+				on[idx], off[idx] = level, 0
+			}
+		}
+		d.Filter(d.history, d.Quantized, d.Filtered)
+
+		var recovered []Data
+		r.Recover(&d, []Data{NewData(received)}, nil, func(pkt Data, flipped int) bool {
+			if flipped != flips {
+				t.Errorf("expected %d bits flipped, got %d", flips, flipped)
+			}
+			recovered = append(recovered, pkt)
+			return true
+		})
+
+		if len(recovered) != 1 {
+			t.Fatalf("%02X: expected 1 recovered packet, got %d", received, len(recovered))
+		}
+		if string(recovered[0].Bytes) != string(data) {
+			t.Fatalf("expected %02X, got %02X", data, recovered[0].Bytes)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import "math"
+
+// Output samples are interpolated at the nearest of this many points between
+// input samples, a timing error of at most 1/256th of a sample.
+const resamplePhases = 128
+
+// Taps of each phase of the resampler's filter when interpolating, more are
+// needed in proportion when decimating or cutting off lower.
+const resampleTaps = 16
+
+// Cutoff of the resampler's filter, as a fraction of half the lower of the two
+// sample rates. The filter rolls off either side of it, rejecting what would
+// alias above that half.
+const resampleBandwidth = 0.9
+
+// A Resampler converts a stream of complex samples from one sample rate to
+// another, whose ratio needn't be an integer or a small fraction. Each output
+// sample is interpolated between input samples by a polyphase windowed sinc
+// low pass filter, which rejects signals that would alias, and optionally
+// those outside a narrower band too.
+type Resampler struct {
+	inRate, outRate int
+
+	// Taps of each phase, interpolating at a fraction phase/resamplePhases
+	// of the way between two input samples. The extra phase interpolates at
+	// the second of them.
+	taps [][]float32
+
+	// Input samples the filter still needs, followed by the newest block.
+	buf []complex64
+
+	// Index in buf of the input sample preceding the next output sample, and
+	// the fraction of an input sample after it, in units of 1/outRate.
+	idx, frac int
+}
+
+// Make a new resampler from inRate to outRate samples per second. Signals
+// more than cutoff Hz from the center frequency are rejected. If cutoff is
+// zero, or beyond what the lower rate passes, only those that would alias are.
+func NewResampler(inRate, outRate int, cutoff float64) *Resampler {
+	r := &Resampler{inRate: inRate, outRate: outRate}
+
+	maxCutoff := resampleBandwidth / 2 * float64(min(inRate, outRate))
+	if cutoff <= 0 || cutoff > maxCutoff {
+		cutoff = maxCutoff
+	}
+
+	// Equal rates without a narrower band are passed through.
+	if inRate == outRate && cutoff == maxCutoff {
+		r.taps = [][]float32{{1}}
+		r.Reset()
+		return r
+	}
+
+	// Taps span enough input samples to cut off as sharply relative to the
+	// cutoff as interpolating does relative to the sample rate.
+	length := int(math.Ceil(resampleTaps * math.Max(1, float64(inRate)*resampleBandwidth/(2*cutoff))))
+	cutoff /= float64(inRate)
+
+	r.taps = make([][]float32, resamplePhases+1)
+	for phase := range r.taps {
+		mu := float64(phase) / resamplePhases
+
+		taps := make([]float32, length)
+		var sum float32
+		for idx := range taps {
+			// Distance of the output sample from this tap's input sample.
+			t := mu + float64(length/2-1-idx)
+
+			h := 2 * cutoff
+			if t != 0 {
+				h = math.Sin(2*math.Pi*cutoff*t) / (math.Pi * t)
+			}
+			h *= 0.54 + 0.46*math.Cos(2*math.Pi*t/float64(length))
+			taps[idx] = float32(h)
+			sum += taps[idx]
+		}
+		for idx := range taps {
+			taps[idx] /= sum
+		}
+		r.taps[phase] = taps
+	}
+
+	r.Reset()
+	return r
+}
+
+// Discard buffered samples, such as after retuning or reconnecting.
+func (r *Resampler) Reset() {
+	length := len(r.taps[0])
+	r.buf = r.buf[:0]
+	r.idx, r.frac = length/2-1, 0
+}
+
+// Resample a block of input samples, appending as many output samples as
+// they complete to out. Samples near the end of the block are held until the
+// next, as the filter needs samples on both sides of each output sample.
+func (r *Resampler) Resample(in, out []complex64) []complex64 {
+	length := len(r.taps[0])
+	r.buf = append(r.buf, in...)
+
+	for r.idx+length-length/2 < len(r.buf) {
+		phase := (r.frac*resamplePhases + r.outRate>>1) / r.outRate
+		taps := r.taps[phase]
+
+		var re, im float32
+		for idx, v := range r.buf[r.idx+1-length/2 : r.idx+1+length-length/2] {
+			re += taps[idx] * real(v)
+			im += taps[idx] * imag(v)
+		}
+		out = append(out, complex(re, im))
+
+		r.frac += r.inRate
+		r.idx += r.frac / r.outRate
+		r.frac %= r.outRate
+	}
+
+	// Keep only the samples the next output sample needs.
+	drop := min(max(r.idx+1-length/2, 0), len(r.buf))
+	r.buf = r.buf[:copy(r.buf, r.buf[drop:])]
+	r.idx -= drop
+
+	return out
+}
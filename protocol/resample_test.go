@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+// Complex exponential of freq Hz sampled at rate.
+func tone(freq float64, rate, n int) []complex64 {
+	samples := make([]complex64, n)
+	for idx := range samples {
+		samples[idx] = complex64(cmplx.Exp(complex(0, 2*math.Pi*freq*float64(idx)/float64(rate))))
+	}
+	return samples
+}
+
+// Tones within the band keep their amplitude and frequency.
+func TestResamplerTone(t *testing.T) {
+	for _, tc := range []struct {
+		inRate, outRate int
+		freq            float64
+	}{
+		{2400000, 2359296, 100e3},
+		{2048000, 2359296, -300e3},
+		{2400000, 1048576, 250e3},
+		{2359296, 2359296, 50e3},
+	} {
+		r := NewResampler(tc.inRate, tc.outRate, 0)
+		out := r.Resample(tone(tc.freq, tc.inRate, 1<<16), nil)
+
+		want := float64(1<<16) * float64(tc.outRate) / float64(tc.inRate)
+		if math.Abs(float64(len(out))-want) > 32 {
+			t.Errorf("%d to %d: expected %.0f samples, got %d", tc.inRate, tc.outRate, want, len(out))
+		}
+
+		rot := cmplx.Exp(complex(0, 2*math.Pi*tc.freq/float64(tc.outRate)))
+		for idx := 64; idx < len(out)-1; idx++ {
+			if mag := cmplx.Abs(complex128(out[idx])); math.Abs(mag-1) > 0.01 {
+				t.Fatalf("%d to %d: expected unit magnitude at %d, got %.4f", tc.inRate, tc.outRate, idx, mag)
+			}
+			if err := cmplx.Abs(complex128(out[idx+1]) - complex128(out[idx])*rot); err > 0.01 {
+				t.Fatalf("%d to %d: expected %.0fHz at %d, off by %.4f", tc.inRate, tc.outRate, tc.freq, idx, err)
+			}
+		}
+	}
+}
+
+// Mean power in dB of a tone once resampled.
+func resampledPower(inRate, outRate int, cutoff, freq float64) float64 {
+	out := NewResampler(inRate, outRate, cutoff).Resample(tone(freq, inRate, 1<<16), nil)
+
+	var power float64
+	for _, v := range out[256:] {
+		power += float64(real(v)*real(v) + imag(v)*imag(v))
+	}
+	return 10 * math.Log10(power/float64(len(out)-256))
+}
+
+// Tones beyond the lower rate's band, or the cutoff if narrower, are rejected
+// rather than aliased.
+func TestResamplerRejection(t *testing.T) {
+	for _, tc := range []struct {
+		inRate, outRate int
+		cutoff, freq    float64
+		pass            bool
+	}{
+		{2400000, 1048576, 0, 900e3, false},
+		{2400000, 2400000, 100e3, 40e3, true},
+		{2400000, 2400000, 100e3, -300e3, false},
+		{2400000, 262144, 100e3, 60e3, true},
+		{2400000, 262144, 100e3, 250e3, false},
+	} {
+		db := resampledPower(tc.inRate, tc.outRate, tc.cutoff, tc.freq)
+		if tc.pass && db < -0.5 {
+			t.Errorf("%d to %d, cutoff %.0fHz: expected %.0fHz passed, got %.1fdB", tc.inRate, tc.outRate, tc.cutoff, tc.freq, db)
+		}
+		if !tc.pass && db > -40 {
+			t.Errorf("%d to %d, cutoff %.0fHz: expected %.0fHz rejected by 40dB, got %.1fdB", tc.inRate, tc.outRate, tc.cutoff, tc.freq, db)
+		}
+	}
+}
+
+// Resampling in blocks of any size gives the same samples as all at once.
+func TestResamplerBlocks(t *testing.T) {
+	in := tone(100e3, 2400000, 1<<14)
+	want := NewResampler(2400000, 2359296, 0).Resample(in, nil)
+
+	r := NewResampler(2400000, 2359296, 0)
+	var got []complex64
+	for start, size := 0, 1; start < len(in); start, size = start+size, size*3%1021+1 {
+		got = r.Resample(in[start:min(start+size, len(in))], got)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("expected %d samples, got %d", len(want), len(got))
+	}
+	for idx := range want {
+		if got[idx] != want[idx] {
+			t.Fatalf("expected sample %d to be %v, got %v", idx, want[idx], got[idx])
+		}
+	}
+}
@@ -0,0 +1,477 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"encoding/binary"
+	"math"
+	"math/cmplx"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// The complex amplitude of each on chip of a packet being cancelled is
+// averaged over this many on chips either side of it, following fading and
+// residual frequency error while averaging out noise and other packets.
+const cancelSpan = 8
+
+// Preambles matched by chance in noise measure an SNR well below this in dB,
+// those of packets decodable at all above it.
+const collisionSNR = 0
+
+// A canceller keeps the complex samples a symbol clock decoded recently, and
+// the packets decoded from them. Once the samples spanning a packet length
+// either side of a decoded packet have arrived, it reconstructs the packet's
+// waveform, subtracts it along with those of other packets decoded there,
+// strongest first, and searches what remains for packets the stronger ones
+// collided with.
+type canceller struct {
+	// Complex samples, the last of which align with the raw samples of the
+	// symbol clock and the first precede them by back samples. Samples are
+	// appended to buf and only shifted back to its start when it fills.
+	iq       []complex64
+	buf      []complex64
+	end      int
+	back     int
+	position int // Of the first quantized sample since the decoder started.
+
+	mu      sync.Mutex
+	packets []*cancelPacket
+
+	// Decodes regions of cancelled samples, three packet lengths long.
+	sub   *Decoder
+	power []float32
+
+	collisions, recovered int
+}
+
+// A packet decoded normally or after cancelling others.
+type cancelPacket struct {
+	position int    // Of its preamble.
+	symbols  string // Sliced bits, one ascii 0 or 1 per symbol.
+	digest   Digest
+	power    float64
+	done     bool // Cancelled, and what remained searched.
+	collided bool // Counted as part of a collision.
+}
+
+// Whether two packets were transmitted at once.
+func (p *cancelPacket) overlaps(q *cancelPacket, symbolLength int) bool {
+	return q.position < p.position+len(p.symbols)*symbolLength && p.position < q.position+len(q.symbols)*symbolLength
+}
+
+// Allocate the canceller of a symbol clock.
+func (d *Decoder) allocateCanceller() {
+	pl := d.Cfg.PacketLength
+
+	c := &canceller{back: 2*pl + d.Cfg.BlockSize}
+	n := c.back + len(d.raw)/d.Cfg.SampleSize
+	c.buf = make([]complex64, 2*n)
+	c.end = n
+	c.iq = c.buf[:n]
+
+	// Regions span a packet length before and after the packets which may
+	// overlap the one being cancelled.
+	sub := *d
+	sub.Cfg.BlockSize = (2*pl + 7) &^ 7
+	sub.Cfg.SampleFormat = "cf32"
+	sub.demod = MagCF32{}
+	sub.Cfg.SampleSize = sub.demod.SampleSize()
+	sub.Cfg.EnergyGate = false
+	sub.Cfg.InterferenceCancellation = false
+	sub.allocate()
+	sub.csum = make([]float32, len(sub.history)+1)
+
+	// Regions are parsed by parsers of their own, pointed at the region's
+	// decoder. Parsers keeping buffers of their own between sample blocks
+	// can't parse samples out of turn and are left out. Those not made by a
+	// registered constructor are shared.
+	sub.preambles = make(map[string][]Parser)
+	for preamble, parsers := range d.preambles {
+		for _, p := range parsers {
+			if _, ok := p.(Resetter); ok {
+				continue
+			}
+			if own, err := NewParser(p.Cfg().Protocol, p.Cfg().ChipLength); err == nil {
+				own.SetDecoder(&sub)
+				p = own
+			}
+			sub.preambles[preamble] = append(sub.preambles[preamble], p)
+		}
+	}
+
+	c.sub = &sub
+	c.power = sub.history
+
+	d.canceller = c
+}
+
+// Append a block of raw samples, the symbol clock's buffers have already
+// been shifted by it.
+func (c *canceller) push(demod ComplexDemodulator, input []byte, blockSize int) {
+	n := len(c.iq)
+	if c.end+blockSize > len(c.buf) {
+		c.end = copy(c.buf, c.buf[c.end-n+blockSize:c.end])
+	}
+	demod.Complex(input, c.buf[c.end:c.end+blockSize])
+	c.end += blockSize
+	c.iq = c.buf[c.end-n : c.end]
+	c.position += blockSize
+}
+
+// Discard buffered samples and packets.
+func (c *canceller) reset() {
+	clear(c.iq)
+	c.packets = c.packets[:0]
+}
+
+// Record a packet decoded from the block being searched.
+func (d *Decoder) decoded(pkt Packet, pkts []Data, parsers []Parser) {
+	if symbols, ok := packetSymbols(pkt, pkts, parsers, d.Cfg.PacketSymbols); ok {
+		d.canceller.add(d.canceller.position+pkt.Idx, symbols, pkt)
+	}
+}
+
+// Returns the symbols of the packet among pkts a message was parsed from, as
+// many as the protocol which parsed it has, all of them if it isn't known.
+func packetSymbols(pkt Packet, pkts []Data, parsers []Parser, n int) (string, bool) {
+	n = protocolSymbols(pkt, parsers, n)
+	for _, data := range pkts {
+		if data.Idx == pkt.Idx {
+			return data.Bits[:n], true
+		}
+	}
+	return "", false
+}
+
+// Add a decoded packet sliced from the given symbols, unless its message is
+// already known. Returns whether it was added.
+func (c *canceller) add(position int, symbols string, pkt Packet) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	digest := NewDigest(pkt)
+	for _, p := range c.packets {
+		// Messages without a checksum are told apart by their symbols,
+		// corrected messages by their digest.
+		if p.symbols == symbols || (digest.Checksum != "" && p.digest == digest) {
+			return false
+		}
+	}
+
+	c.packets = append(c.packets, &cancelPacket{
+		position: position,
+		symbols:  symbols,
+		digest:   digest,
+		power:    math.Pow(10, pkt.RSSI/10),
+	})
+	return true
+}
+
+// Cancel each decoded packet whose region has arrived, sending the messages
+// recovered to msgCh.
+func (d *Decoder) cancel(input []byte, msgCh chan Message) {
+	c := d.canceller
+	c.push(d.demod.(ComplexDemodulator), input, d.Cfg.BlockSize)
+
+	pl := d.Cfg.PacketLength
+	start := c.position - c.back
+	end := start + len(c.iq)
+
+	// Forget packets too old to be part of a region.
+	packets := c.packets[:0]
+	for _, p := range c.packets {
+		if p.position+pl > start {
+			packets = append(packets, p)
+		}
+	}
+	c.packets = packets
+
+	// A region is ready once its samples have arrived and every preamble
+	// which may overlap the packet has been searched for normally, so that
+	// packets decoded normally aren't taken for recovered ones. Packets
+	// recovered may have regions of their own ready.
+	for {
+		var next *cancelPacket
+		for _, p := range c.packets {
+			if !p.done && p.position+pl <= c.position && p.position-pl+len(c.power) <= end {
+				next = p
+				break
+			}
+		}
+		if next == nil {
+			return
+		}
+		next.done = true
+
+		msgs := d.cancelRegion(next, next.position-pl-start)
+		if len(msgs) == 0 {
+			continue
+		}
+
+		d.wg.Add(1)
+		go func(msgs []Message) {
+			defer d.wg.Done()
+			for _, msg := range msgs {
+				msgCh <- msg
+			}
+		}(msgs)
+	}
+}
+
+// Subtract the packets decoded around p from the region of samples starting
+// at offset in iq, search what remains for others and count the collisions
+// p was part of. Returns the messages recovered.
+func (d *Decoder) cancelRegion(p *cancelPacket, offset int) (msgs []Message) {
+	c := d.canceller
+	sub := c.sub
+	pl := d.Cfg.PacketLength
+	sl := d.Cfg.SymbolLength
+	position := c.position - c.back + offset
+
+	// The region may begin before the oldest samples held.
+	region := make([]complex64, len(c.power))
+	if offset < 0 {
+		copy(region[-offset:], c.iq)
+	} else {
+		copy(region, c.iq[offset:])
+	}
+
+	// Cancel the packets overlapping the region, strongest first so that
+	// weaker ones are estimated with less interference.
+	var cancelled []*cancelPacket
+	for _, q := range c.packets {
+		if q.position+len(q.symbols)*sl > position && q.position < position+len(region) {
+			cancelled = append(cancelled, q)
+		}
+	}
+	sort.Slice(cancelled, func(i, j int) bool {
+		return cancelled[i].power > cancelled[j].power
+	})
+	for _, q := range cancelled {
+		d.subtract(region, q.position-position, q.symbols)
+	}
+
+	for idx, v := range region {
+		c.power[idx] = real(v)*real(v) + imag(v)*imag(v)
+		binary.LittleEndian.PutUint32(sub.raw[idx<<3:], math.Float32bits(real(v)))
+		binary.LittleEndian.PutUint32(sub.raw[idx<<3+4:], math.Float32bits(imag(v)))
+	}
+	sub.Filter(c.power, sub.Quantized, sub.Filtered)
+
+	preambles := d.preambles
+	if d.active != nil {
+		preambles = d.active
+	}
+
+	// Preambles remaining, other than traces of the packets cancelled and
+	// chance matches in noise.
+	var hits []int
+
+	for preamble, parsers := range preambles {
+		var indices []int
+		if d.Cfg.PreambleThreshold > 0 {
+			indices = sub.SearchSoft([]byte(preamble))
+		} else {
+			indices = sub.Search([]byte(preamble))
+		}
+		for _, qIdx := range indices {
+			trace := slices.ContainsFunc(cancelled, func(q *cancelPacket) bool {
+				return abs(position+qIdx-q.position) <= sl
+			})
+			if !trace && sub.Measure(qIdx, len(preamble)).SNR >= collisionSNR {
+				hits = append(hits, position+qIdx)
+			}
+		}
+
+		var pkts []Data
+		if d.Cfg.PreambleThreshold > 0 {
+			pkts = sub.Slice(indices, []byte(preamble))
+		} else {
+			pkts = sub.Slice(indices, nil)
+		}
+		if len(pkts) == 0 {
+			continue
+		}
+
+		for _, msg := range sub.parseRegion(pkts, preamble) {
+			pkt, ok := msg.(Packet)
+			if !ok {
+				continue
+			}
+
+			symbols, ok := packetSymbols(pkt, pkts, parsers, d.Cfg.PacketSymbols)
+			if !ok {
+				continue
+			}
+
+			pkt.Signal = sub.Measure(pkt.Idx, len(preamble))
+			if !c.add(position+pkt.Idx, symbols, pkt) {
+				continue
+			}
+			c.recovered++
+
+			// Index the packet relative to the symbol clock's buffers.
+			pkt.Idx += position - c.position
+			d.span(&pkt, parsers)
+			msgs = append(msgs, pkt)
+		}
+	}
+
+	// Packets decoded overlapping the packet collided with it, as did those
+	// whose preambles remain once it and the packets known are cancelled.
+	// Each collision is counted once, by the first of its packets cancelled.
+	collided := slices.ContainsFunc(c.packets, func(q *cancelPacket) bool {
+		return q != p && p.overlaps(q, sl)
+	})
+	for _, h := range hits {
+		if h > p.position-pl && h < p.position+len(p.symbols)*sl {
+			collided = true
+		}
+	}
+	if !collided {
+		return msgs
+	}
+
+	if !p.collided {
+		c.collisions++
+	}
+	for _, q := range c.packets {
+		if p.overlaps(q, sl) {
+			q.collided = true
+		}
+	}
+
+	return msgs
+}
+
+// Run a region decoder's parsers of a preamble on packets sliced from the
+// region.
+func (d *Decoder) parseRegion(pkts []Data, preamble string) (msgs []Message) {
+	pktCh := make(chan Message)
+	pktWg := new(sync.WaitGroup)
+
+	parsers := d.preambles[preamble]
+	pktWg.Add(len(parsers))
+	for _, p := range parsers {
+		go p.Parse(pkts, pktCh, pktWg)
+	}
+
+	go func() {
+		pktWg.Wait()
+		close(pktCh)
+	}()
+
+	for msg := range pktCh {
+		msgs = append(msgs, msg)
+	}
+
+	return msgs
+}
+
+// Subtract from iq the waveform of a packet whose preamble was found near
+// idx. Its on chips are aligned by their contrast with its off chips, and the
+// amplitude of each is estimated at the packet's carrier frequency.
+func (d *Decoder) subtract(iq []complex64, idx int, symbols string) {
+	cl := d.Cfg.ChipLength
+	sl := d.Cfg.SymbolLength
+
+	csum := make([]float64, len(iq)+1)
+	for i, v := range iq {
+		csum[i+1] = csum[i] + float64(real(v)*real(v)+imag(v)*imag(v))
+	}
+	chip := func(start int) float64 {
+		if start < 0 || start+cl > len(iq) {
+			return 0
+		}
+		return csum[start+cl] - csum[start]
+	}
+
+	// The preamble is found up to a chip either side of the symbol boundary.
+	best, bestContrast := idx, math.Inf(-1)
+	for offset := idx - cl; offset <= idx+cl; offset++ {
+		var contrast float64
+		for sym := range symbols {
+			on, off := d.chips(offset+sym*sl, symbols[sym]-'0')
+			if on >= 0 {
+				contrast += chip(on)
+			}
+			if off >= 0 {
+				contrast -= chip(off)
+			}
+		}
+		if contrast > bestContrast {
+			best, bestContrast = offset, contrast
+		}
+	}
+
+	var starts []int
+	for sym := range symbols {
+		on, _ := d.chips(best+sym*sl, symbols[sym]-'0')
+		if on >= 0 && on+cl <= len(iq) {
+			starts = append(starts, on)
+		}
+	}
+	if len(starts) == 0 {
+		return
+	}
+
+	freq := carrierFreq(iq, starts, cl, float64(d.Cfg.SampleRate))
+	rot := cmplx.Exp(complex(0, -2*math.Pi*freq/float64(d.Cfg.SampleRate)))
+
+	// Mean of each on chip mixed down to baseband, the carrier's phase
+	// referenced to the start of the region.
+	mean := make([]complex128, len(starts))
+	for i, start := range starts {
+		phase := cmplx.Pow(rot, complex(float64(start), 0))
+		var sum complex128
+		for _, v := range iq[start : start+cl] {
+			sum += complex128(v) * phase
+			phase *= rot
+		}
+		mean[i] = sum / complex(float64(cl), 0)
+	}
+
+	for i, start := range starts {
+		var amplitude complex128
+		lo, hi := max(i-cancelSpan, 0), min(i+cancelSpan+1, len(mean))
+		for _, m := range mean[lo:hi] {
+			amplitude += m
+		}
+		amplitude /= complex(float64(hi-lo), 0)
+
+		phase := amplitude / cmplx.Pow(rot, complex(float64(start), 0))
+		for j := start; j < start+cl; j++ {
+			iq[j] -= complex64(phase)
+			phase /= rot
+		}
+	}
+}
+
+// CancellationStats returns the number of collisions found between packets,
+// and the number of packets recovered by cancelling the stronger packets they
+// collided with.
+func (d *Decoder) CancellationStats() (collisions, recovered int) {
+	for _, c := range append(d.clockDecoders(), d) {
+		if c.canceller != nil {
+			collisions += c.canceller.collisions
+			recovered += c.canceller.recovered
+		}
+	}
+	return collisions, recovered
+}
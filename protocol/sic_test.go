@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// A parser sending the bits of only the packets transmitted, as a checksum
+// would reject the rest.
+type checkedParser struct {
+	bitsParser
+	valid map[string]bool
+}
+
+func (p checkedParser) Parse(pkts []Data, msgCh chan Message, wg *sync.WaitGroup) {
+	for _, pkt := range pkts {
+		if bits := pkt.Bits[:p.cfg.PacketSymbols]; p.valid[bits] {
+			msgCh <- Packet{Message: bitsMessage{p.cfg.Protocol, bits}, Idx: pkt.Idx}
+		}
+	}
+	wg.Done()
+}
+
+// Decodes pairs of packets colliding with each other, the weaker level dB
+// below the stronger on a carrier a few kHz away. Returns the number of
+// stronger and weaker packets found and the decoder's cancellation
+// statistics.
+func decodeCollisions(sic bool, level float64) (strong, weak, collisions, recovered int) {
+	cfg := PacketConfig{
+		Protocol:        "scm",
+		Preamble:        scmPreamble,
+		DataRate:        32768,
+		ChipLength:      8,
+		PreambleSymbols: len(scmPreamble),
+		PacketSymbols:   96,
+	}
+
+	want := map[string]bool{}
+	d := NewDecoder()
+	d.RegisterProtocol(checkedParser{bitsParser{cfg}, want})
+	d.Cfg.InterferenceCancellation = sic
+	d.Allocate()
+
+	rng := rand.New(rand.NewSource(1))
+
+	const pairs = 20
+	pl := d.clocks[0].Cfg.PacketLength
+	spacing := 4 * pl
+	n := (pairs + 2) * spacing
+	iq := make([]complex128, n)
+	for idx := range iq {
+		iq[idx] = complex(rng.NormFloat64(), rng.NormFloat64()) * 0.03
+	}
+
+	add := func(start int, amplitude, freq float64) string {
+		bits := []byte(cfg.Preamble)
+		for len(bits) < cfg.PacketSymbols {
+			bits = append(bits, '0'+byte(rng.Intn(2)))
+		}
+
+		phase := rng.Float64() * 2 * math.Pi
+		for sIdx, bit := range bits {
+			chip := sIdx * 2
+			if bit == '0' {
+				chip++
+			}
+			for idx := chip * cfg.ChipLength; idx < (chip+1)*cfg.ChipLength; idx++ {
+				theta := phase + 2*math.Pi*freq*float64(idx)/float64(d.Cfg.SampleRate)
+				iq[start+idx] += complex(amplitude*math.Cos(theta), amplitude*math.Sin(theta))
+			}
+		}
+		return string(bits)
+	}
+
+	strongBits := map[string]bool{}
+	for pIdx := 0; pIdx < pairs; pIdx++ {
+		start := (pIdx+1)*spacing + rng.Intn(d.Cfg.BlockSize)
+
+		// Either packet may start first, overlapping most of the other.
+		delay := pl/8 + rng.Intn(pl*3/4)
+		if pIdx&1 == 1 {
+			delay = -delay
+		}
+
+		s := add(start, 0.3, 1000)
+		w := add(start+delay, 0.3*math.Pow(10, level/20), -3000)
+		strongBits[s] = true
+		want[s], want[w] = true, true
+	}
+
+	samples := make([]byte, n<<1)
+	for idx, v := range iq {
+		samples[idx<<1], samples[idx<<1|1] = impair(real(v), imag(v), 0, 1, 0)
+	}
+
+	found := map[string]bool{}
+	blockBytes := d.Cfg.BlockSize * d.Cfg.SampleSize
+	for idx := 0; idx+blockBytes <= len(samples); idx += blockBytes {
+		for msg := range d.Decode(samples[idx : idx+blockBytes]) {
+			bits := msg.(Packet).Message.(bitsMessage).bits
+			if found[bits] {
+				continue
+			}
+			found[bits] = true
+			if strongBits[bits] {
+				strong++
+			} else {
+				weak++
+			}
+		}
+	}
+
+	collisions, recovered = d.CancellationStats()
+	return strong, weak, collisions, recovered
+}
+
+// Cancelling the stronger of colliding packets recovers the weaker, without
+// losing any of the stronger.
+func TestInterferenceCancellation(t *testing.T) {
+	strong, weak, _, _ := decodeCollisions(false, -6)
+	if strong < 18 {
+		t.Fatalf("expected most stronger packets decoded, got %d", strong)
+	}
+	if weak > 10 {
+		t.Fatalf("expected most weaker packets lost, got %d", weak)
+	}
+
+	sicStrong, sicWeak, collisions, recovered := decodeCollisions(true, -6)
+	if sicStrong < strong {
+		t.Errorf("expected cancellation to keep %d stronger packets, got %d", strong, sicStrong)
+	}
+	if sicWeak < 18 {
+		t.Errorf("expected cancellation to recover weaker packets, got %d of 20, %d without", sicWeak, weak)
+	}
+	if recovered < sicWeak-weak {
+		t.Errorf("expected %d packets counted as recovered, got %d", sicWeak-weak, recovered)
+	}
+	if collisions < 18 || collisions > 20 {
+		t.Errorf("expected a collision counted for most of the 20 pairs, got %d", collisions)
+	}
+}
@@ -0,0 +1,200 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+)
+
+// Signal describes the signal a packet was decoded from. RSSI and Noise are
+// in dB relative to full scale, SNR is in dB and FreqOffset is the carrier's
+// offset from the center frequency in Hz.
+type Signal struct {
+	RSSI       float64 `xml:",attr"`
+	Noise      float64 `xml:",attr"`
+	SNR        float64 `xml:",attr"`
+	FreqOffset float64 `xml:",attr"`
+}
+
+func (s Signal) String() string {
+	return fmt.Sprintf("RSSI:%.1f Noise:%.1f SNR:%.1f FreqOffset:%.0f", s.RSSI, s.Noise, s.SNR, s.FreqOffset)
+}
+
+// A Packet is a message along with the index into the quantized signal its
+// preamble was found at and the number of bit errors corrected to parse it.
+// Parsers send packets so the decoder can measure the signal each message was
+// decoded from, and tag it with the frequency of the channel it was heard on.
+type Packet struct {
+	Message
+	Idx       int
+	Corrected int
+	Frequency uint32
+	Signal
+
+	// Samples the packet spans, the first relative to the first sample of
+	// the block it was decoded from, negative if it began in an earlier one.
+	Start, Length int
+}
+
+// Measure the signal of a packet whose preamble was found at idx and is
+// preambleSymbols long. The quantized bit of each symbol says which of its
+// chips are on and off, on chips give the packet's power and off chips the
+// noise floor.
+func (d *Decoder) Measure(idx, preambleSymbols int) (s Signal) {
+	cl := d.Cfg.ChipLength
+	sl := d.Cfg.SymbolLength
+
+	// The preamble is found at the first index the matched filter agrees
+	// with it, which may be up to a chip before the symbol boundary. Find the
+	// offset at which on and off chips are best separated.
+	lo := max(idx-cl, 0)
+	hi := min(idx+cl+preambleSymbols*sl, len(d.history))
+
+	csum := make([]float64, hi-lo+1)
+	for i, v := range d.history[lo:hi] {
+		csum[i+1] = csum[i] + float64(v)
+	}
+	chip := func(start int) float64 {
+		return csum[start-lo+cl] - csum[start-lo]
+	}
+
+	best, bestContrast := idx, math.Inf(-1)
+	for offset := lo; offset+preambleSymbols*sl <= hi; offset++ {
+		var contrast float64
+		for sym := 0; sym < preambleSymbols; sym++ {
+			on, off := d.chips(offset+sym*sl, d.Quantized[idx+sym*sl])
+			if on >= 0 {
+				contrast += chip(on)
+			}
+			if off >= 0 {
+				contrast -= chip(off)
+			}
+		}
+		if contrast > bestContrast {
+			best, bestContrast = offset, contrast
+		}
+	}
+
+	var on, off float64
+	var onChips, offChips int
+	for sym := 0; sym < preambleSymbols; sym++ {
+		onIdx, offIdx := d.chips(best+sym*sl, d.Quantized[idx+sym*sl])
+		if onIdx >= 0 {
+			on += chip(onIdx)
+			onChips++
+		}
+		if offIdx >= 0 {
+			off += chip(offIdx)
+			offChips++
+		}
+	}
+
+	on /= float64(max(onChips*cl, 1))
+	off /= float64(max(offChips*cl, 1))
+
+	s.RSSI = decibels(on)
+	s.Noise = decibels(off)
+	s.SNR = decibels(math.Max(on-off, 1e-12) / math.Max(off, 1e-12))
+	s.FreqOffset = d.freqOffset(best, idx, preambleSymbols)
+
+	return s
+}
+
+// Estimate the carrier frequency offset of a preamble aligned at best from
+// the phase rotation between samples of its on chips. Returns zero if the
+// demodulator can't provide complex samples.
+func (d *Decoder) freqOffset(best, idx, preambleSymbols int) float64 {
+	demod, ok := d.demod.(ComplexDemodulator)
+	if !ok {
+		return 0
+	}
+
+	cl := d.Cfg.ChipLength
+	sl := d.Cfg.SymbolLength
+	ss := d.Cfg.SampleSize
+
+	n := preambleSymbols * sl
+	iq := make([]complex64, n)
+	demod.Complex(d.raw[best*ss:(best+n)*ss], iq)
+
+	var starts []int
+	for sym := 0; sym < preambleSymbols; sym++ {
+		if start, _ := d.chips(sym*sl, d.Quantized[idx+sym*sl]); start >= 0 {
+			starts = append(starts, start)
+		}
+	}
+
+	return math.Round(carrierFreq(iq, starts, cl, float64(d.Cfg.SampleRate)))
+}
+
+// Estimate the carrier frequency in Hz of the on chips of length cl starting
+// at each of starts in iq from the phase rotation between their samples.
+func carrierFreq(iq []complex64, starts []int, cl int, sampleRate float64) float64 {
+	// Adjacent samples give an unambiguous coarse estimate. Samples half a
+	// chip apart rotate further, refining it.
+	lag := max(cl>>1, 1)
+
+	var coarse, fine complex128
+	for _, start := range starts {
+		chip := iq[start : start+cl]
+		for i := 1; i < cl; i++ {
+			coarse += complex128(chip[i] * conj(chip[i-1]))
+		}
+		for i := lag; i < cl; i++ {
+			fine += complex128(chip[i] * conj(chip[i-lag]))
+		}
+	}
+
+	coarseFreq := cmplx.Phase(coarse) / (2 * math.Pi) * sampleRate
+
+	// The fine estimate wraps every sampleRate/lag Hz, take the alias nearest
+	// the coarse estimate.
+	period := sampleRate / float64(lag)
+	fineFreq := cmplx.Phase(fine) / (2 * math.Pi) * period
+	fineFreq += math.Round((coarseFreq-fineFreq)/period) * period
+
+	return fineFreq
+}
+
+// Returns the start of the on and off chips of a symbol starting at start
+// whose quantized bit is given, -1 if the symbol has none.
+func (d *Decoder) chips(start int, bit byte) (on, off int) {
+	if d.Cfg.Coding == NRZ {
+		if bit == 1 {
+			return start, -1
+		}
+		return -1, start
+	}
+
+	if bit == 1 {
+		return start, start + d.Cfg.ChipLength
+	}
+	return start + d.Cfg.ChipLength, start
+}
+
+func conj(c complex64) complex64 {
+	return complex(real(c), -imag(c))
+}
+
+// Power ratio in decibels rounded to a tenth, values too small to measure
+// are clamped to -120dB.
+func decibels(power float64) float64 {
+	db := 10 * math.Log10(math.Max(power, 1e-12))
+	return math.Round(db*10) / 10
+}
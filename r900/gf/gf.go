@@ -170,3 +170,195 @@ func (f *Field) Syndrome(message []byte, paritySymbolCount, offset int) (syndrom
 
 	return syndrome
 }
+
+// Calculate the parity symbols which, appended to message, form a codeword
+// whose syndrome is zero. Offset defines the coefficient offset as for
+// Syndrome.
+func (f *Field) Parity(message []byte, paritySymbolCount, offset int) (parity []byte) {
+	if offset < 0 || offset > f.order {
+		panic("gf: invalid offset: " + strconv.Itoa(offset))
+	}
+
+	if paritySymbolCount < 0 {
+		panic("gf: invalid paritySymbolCount: " + strconv.Itoa(paritySymbolCount))
+	}
+
+	// Generator polynomial is the product of (x - α^(offset+i)), highest
+	// degree first.
+	gen := []byte{1}
+	for idx := 0; idx < paritySymbolCount; idx++ {
+		root := f.Exp(offset + idx)
+		next := make([]byte, len(gen)+1)
+		for i, c := range gen {
+			next[i] ^= c
+			next[i+1] ^= f.Mul(c, root)
+		}
+		gen = next
+	}
+
+	// Parity is the remainder of the message shifted by paritySymbolCount
+	// divided by the generator.
+	rem := make([]byte, len(message)+paritySymbolCount)
+	copy(rem, message)
+	for idx := range message {
+		coef := rem[idx]
+		if coef == 0 {
+			continue
+		}
+		for i, g := range gen {
+			rem[idx+i] ^= f.Mul(g, coef)
+		}
+	}
+
+	return rem[len(message):]
+}
+
+// Correct errors in a message encoded using the field generated for a
+// particular Reed-Solomon polynomial, in place. Offset defines the coefficient
+// offset as for Syndrome. Up to paritySymbolCount/2 symbol errors can be
+// corrected. Returns the number of symbols corrected, or -1 if the errors
+// can't be corrected, in which case message is unchanged.
+func (f *Field) Correct(message []byte, paritySymbolCount, offset int) int {
+	syndrome := f.Syndrome(message, paritySymbolCount, offset)
+
+	corrupt := false
+	for _, s := range syndrome {
+		corrupt = corrupt || s != 0
+	}
+	if !corrupt {
+		return 0
+	}
+
+	locator := f.berlekampMassey(syndrome)
+	count := len(locator) - 1
+	if count<<1 > paritySymbolCount {
+		return -1
+	}
+
+	positions := f.chienSearch(locator, len(message))
+	if len(positions) != count {
+		return -1
+	}
+
+	magnitudes := f.forney(syndrome, locator, positions, len(message), offset)
+
+	for idx, pos := range positions {
+		message[pos] ^= magnitudes[idx]
+	}
+
+	// With more errors than can be corrected, the result may not be a
+	// codeword.
+	for _, s := range f.Syndrome(message, paritySymbolCount, offset) {
+		if s != 0 {
+			for idx, pos := range positions {
+				message[pos] ^= magnitudes[idx]
+			}
+			return -1
+		}
+	}
+
+	return count
+}
+
+// berlekampMassey returns the error locator polynomial of the syndrome,
+// lowest degree coefficient first.
+func (f *Field) berlekampMassey(syndrome []byte) []byte {
+	locator := []byte{1}
+	prev := []byte{1}
+	prevDiscrepancy := byte(1)
+	length := 0
+	shift := 1
+
+	for n := range syndrome {
+		discrepancy := syndrome[n]
+		for i := 1; i <= length && i < len(locator); i++ {
+			discrepancy ^= f.Mul(locator[i], syndrome[n-i])
+		}
+
+		if discrepancy == 0 {
+			shift++
+			continue
+		}
+
+		// locator -= discrepancy / prevDiscrepancy * x^shift * prev
+		scale := f.Mul(discrepancy, f.Inv(prevDiscrepancy))
+		next := make([]byte, max(len(locator), len(prev)+shift))
+		copy(next, locator)
+		for i, c := range prev {
+			next[i+shift] ^= f.Mul(scale, c)
+		}
+
+		if length<<1 <= n {
+			prev = locator
+			prevDiscrepancy = discrepancy
+			length = n + 1 - length
+			shift = 1
+		} else {
+			shift++
+		}
+		locator = next
+	}
+
+	// Trim to the degree of the locator.
+	for len(locator) > 1 && locator[len(locator)-1] == 0 {
+		locator = locator[:len(locator)-1]
+	}
+
+	return locator
+}
+
+// chienSearch returns the positions in a message of n symbols, first symbol
+// first, whose error locators are roots of the locator polynomial.
+func (f *Field) chienSearch(locator []byte, n int) (positions []int) {
+	for pos := 0; pos < n; pos++ {
+		// The symbol at pos is the coefficient of x^(n-1-pos), its locator is
+		// the inverse of α^(n-1-pos).
+		x := f.Inv(f.Exp(n - 1 - pos))
+		if f.eval(locator, x) == 0 {
+			positions = append(positions, pos)
+		}
+	}
+	return positions
+}
+
+// forney returns the error magnitude at each position.
+func (f *Field) forney(syndrome, locator []byte, positions []int, n, offset int) []byte {
+	// The evaluator polynomial is syndrome * locator mod x^len(syndrome).
+	evaluator := make([]byte, len(syndrome))
+	for i, s := range syndrome {
+		for j, l := range locator {
+			if i+j < len(evaluator) {
+				evaluator[i+j] ^= f.Mul(s, l)
+			}
+		}
+	}
+
+	// In characteristic 2 the formal derivative keeps only odd terms.
+	derivative := make([]byte, len(locator))
+	for i := 1; i < len(locator); i += 2 {
+		derivative[i-1] = locator[i]
+	}
+
+	magnitudes := make([]byte, len(positions))
+	for idx, pos := range positions {
+		degree := n - 1 - pos
+		x := f.Exp(degree)
+		xInv := f.Inv(x)
+
+		// e = x^(1-offset) * evaluator(x^-1) / locator'(x^-1)
+		e := f.Mul(f.eval(evaluator, xInv), f.Inv(f.eval(derivative, xInv)))
+		e = f.Mul(e, f.Exp(((1-offset)*degree%f.order+f.order)%f.order))
+		magnitudes[idx] = e
+	}
+
+	return magnitudes
+}
+
+// eval returns the polynomial, lowest degree coefficient first, evaluated
+// at x.
+func (f *Field) eval(poly []byte, x byte) (y byte) {
+	for idx := len(poly) - 1; idx >= 0; idx-- {
+		y = f.Mul(y, x) ^ poly[idx]
+	}
+	return y
+}
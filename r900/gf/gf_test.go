@@ -0,0 +1,60 @@
+package gf
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+const (
+	Trials = 512
+)
+
+// Up to half as many symbol errors as parity symbols must be corrected.
+func TestCorrect(t *testing.T) {
+	field := NewField(32, 37, 2)
+
+	for trial := 0; trial < Trials; trial++ {
+		codeword := make([]byte, 31)
+		for idx := range codeword[:26] {
+			codeword[idx] = byte(rand.Intn(32))
+		}
+		copy(codeword[26:], field.Parity(codeword[:26], 5, 29))
+
+		received := append([]byte(nil), codeword...)
+		errors := rand.Intn(3)
+		for _, pos := range rand.Perm(len(received))[:errors] {
+			received[pos] ^= byte(rand.Intn(31) + 1)
+		}
+
+		if corrected := field.Correct(received, 5, 29); corrected != errors {
+			t.Fatalf("expected %d corrected symbols, got %d", errors, corrected)
+		}
+		if !bytes.Equal(received, codeword) {
+			t.Fatalf("expected %02X, got %02X", codeword, received)
+		}
+	}
+}
+
+// Messages with too many errors must be rejected or decoded to a codeword.
+func TestCorrectUncorrectable(t *testing.T) {
+	field := NewField(32, 37, 2)
+
+	for trial := 0; trial < Trials; trial++ {
+		received := make([]byte, 31)
+		for idx := range received {
+			received[idx] = byte(rand.Intn(32))
+		}
+		original := append([]byte(nil), received...)
+
+		corrected := field.Correct(received, 5, 29)
+		switch {
+		case corrected < 0:
+			if !bytes.Equal(received, original) {
+				t.Fatalf("rejected message was modified")
+			}
+		case !bytes.Equal(field.Syndrome(received, 5, 29), make([]byte, 5)):
+			t.Fatalf("corrected %d symbols to a non-codeword %02X", corrected, received)
+		}
+	}
+}
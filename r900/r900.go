@@ -19,6 +19,8 @@ package r900
 import (
 	"bytes"
 	"fmt"
+	"slices"
+	"sort"
 	"strconv"
 	"sync"
 
@@ -30,6 +32,14 @@ const (
 	PayloadSymbols = 42
 )
 
+// GF of order 32, polynomial 37, generator 2.
+var field = gf.NewField(32, 37, 2)
+
+// Maximum number of symbol errors corrected in each packet, zero disables
+// correction. The Reed-Solomon code can correct up to 2, though each symbol
+// corrected makes accepting a corrupt packet more likely.
+var MaxCorrection int
+
 func init() {
 	protocol.RegisterParser("r900", NewParser)
 }
@@ -64,8 +74,7 @@ func NewParser(chipLength int) protocol.Parser {
 		Preamble:        "00000000000000001110010101100100",
 	}
 
-	// GF of order 32, polynomial 37, generator 2.
-	p.field = gf.NewField(32, 37, 2)
+	p.field = field
 
 	return &p
 }
@@ -78,6 +87,12 @@ func (p *Parser) Cfg() protocol.PacketConfig {
 	return p.cfg
 }
 
+// Discard buffered signal, called when the decoder is reset.
+func (p *Parser) Reset() {
+	clear(p.signal)
+	clear(p.quantized)
+}
+
 // Perform matched filtering.
 func (p *Parser) filter() {
 	// This function computes the convolution of each symbol kernel with the
@@ -149,7 +164,7 @@ func (p *Parser) filter() {
 	}
 }
 
-func abs[F float32 | float64](x F) F {
+func abs[F int | float32 | float64](x F) F {
 	if x < 0 {
 		return -x
 	}
@@ -158,14 +173,16 @@ func abs[F float32 | float64](x F) F {
 
 // Given a list of indices the preamble exists at, decode and parse a message.
 func (p *Parser) Parse(pkts []protocol.Data, msgCh chan protocol.Message, wg *sync.WaitGroup) {
+	// The decoder's configuration is used rather than the parser's, which
+	// must keep describing the protocol.
+	cfg := p.Decoder.Cfg
+
 	p.once.Do(func() {
-		p.cfg = p.Decoder.Cfg
 		p.signal = make([]float32, p.Decoder.Cfg.BufferLength)
 		p.csum = make([]float32, p.Decoder.Cfg.BufferLength+1)
 		p.quantized = make([]byte, p.Decoder.Cfg.BufferLength)
 	})
 
-	cfg := p.cfg
 	copy(p.signal, p.signal[cfg.BlockSize:])
 	copy(p.signal[cfg.PacketLength:], p.Decoder.Signal[cfg.SymbolLength:])
 
@@ -175,16 +192,24 @@ func (p *Parser) Parse(pkts []protocol.Data, msgCh chan protocol.Message, wg *sy
 	chipLength := cfg.ChipLength
 
 	symbols := make([]byte, 21)
-	zeros := make([]byte, 5)
+	zeros := make([]byte, 10)
 
 	seen := make(map[string]bool)
 
+	// Packets with symbol errors are corrected once all intact packets are
+	// seen. Misaligned copies of a packet can often be corrected too, into
+	// garbage, so corrections overlapping an accepted packet are discarded.
+	var (
+		accepted  []int
+		corrected []correction
+	)
+
 	for _, pkt := range pkts {
 		if pkt.Idx > cfg.BlockSize {
 			break
 		}
 
-		payloadIdx := pkt.Idx + preambleLength - p.cfg.SymbolLength
+		payloadIdx := pkt.Idx + preambleLength - cfg.SymbolLength
 		var digits string
 		for idx := 0; idx < PayloadSymbols*4*cfg.ChipLength; idx += chipLength * 4 {
 			qIdx := payloadIdx + idx
@@ -192,61 +217,92 @@ func (p *Parser) Parse(pkts []protocol.Data, msgCh chan protocol.Message, wg *sy
 			digits += strconv.Itoa(int(p.quantized[qIdx]))
 		}
 
-		var (
-			bits      string
-			badSymbol bool
-		)
+		if seen[digits] {
+			continue
+		}
+		seen[digits] = true
+
+		// Digit pairs greater than 31 aren't symbols, they're errors.
+		badSymbol := false
 		for idx := 0; idx < len(digits); idx += 2 {
 			symbol, _ := strconv.ParseInt(digits[idx:idx+2], 6, 32)
 			if symbol > 31 {
 				badSymbol = true
-				break
+				symbol = 0
 			}
 			symbols[idx>>1] = byte(symbol)
-			bits += fmt.Sprintf("%05b", symbol)
 		}
 
-		if badSymbol || seen[bits] {
+		// The code is shortened, data symbols are followed by zeros in place
+		// of the 10 untransmitted symbols.
+		copy(p.rsBuf[:], symbols[:16])
+		clear(p.rsBuf[16:26])
+		copy(p.rsBuf[26:], symbols[16:])
+
+		if !badSymbol && bytes.Equal(p.field.Syndrome(p.rsBuf[:], 5, 29), zeros[:5]) {
+			p.send(msgCh, pkt.Idx, 0)
+			accepted = append(accepted, pkt.Idx)
 			continue
 		}
 
-		seen[bits] = true
+		if MaxCorrection == 0 {
+			continue
+		}
 
-		copy(p.rsBuf[:], symbols[:16])
-		copy(p.rsBuf[26:], symbols[16:])
-		syndromes := p.field.Syndrome(p.rsBuf[:], 5, 29)
+		// Errors located in the untransmitted symbols are miscorrections.
+		count := p.field.Correct(p.rsBuf[:], 5, 29)
+		if count < 0 || count > MaxCorrection || !bytes.Equal(p.rsBuf[16:26], zeros) {
+			continue
+		}
+
+		corrected = append(corrected, correction{pkt.Idx, count, p.rsBuf})
+	}
 
-		if !bytes.Equal(zeros, syndromes) {
+	// Prefer the corrections of the fewest symbols.
+	sort.SliceStable(corrected, func(i, j int) bool {
+		return corrected[i].count < corrected[j].count
+	})
+
+	for _, c := range corrected {
+		if slices.ContainsFunc(accepted, func(idx int) bool {
+			return abs(c.idx-idx) < cfg.PacketLength
+		}) {
 			continue
 		}
 
-		id, _ := strconv.ParseUint(bits[:32], 2, 32)
-		unkn1, _ := strconv.ParseUint(bits[32:40], 2, 8)
-		nouse, _ := strconv.ParseUint(bits[40:46], 2, 6)
-		backflow, _ := strconv.ParseUint(bits[46:48], 2, 2)
-		consumption, _ := strconv.ParseUint(bits[48:72], 2, 24)
-		unkn3, _ := strconv.ParseUint(bits[72:74], 2, 2)
-		leak, _ := strconv.ParseUint(bits[74:78], 2, 4)
-		leaknow, _ := strconv.ParseUint(bits[78:80], 2, 2)
-
-		var r900 R900
-
-		r900.ID = uint32(id)
-		r900.Unkn1 = uint8(unkn1)
-		r900.NoUse = uint8(nouse)
-		r900.BackFlow = uint8(backflow)
-		r900.Consumption = uint32(consumption)
-		r900.Unkn3 = uint8(unkn3)
-		r900.Leak = uint8(leak)
-		r900.LeakNow = uint8(leaknow)
-		copy(r900.checksum[:], symbols[16:])
-
-		msgCh <- r900
+		p.rsBuf = c.rsBuf
+		p.send(msgCh, c.idx, c.count)
+		accepted = append(accepted, c.idx)
 	}
 
 	wg.Done()
 }
 
+// A packet whose symbol errors were corrected.
+type correction struct {
+	idx   int
+	count int
+	rsBuf [31]byte
+}
+
+// Send the message whose symbols are in the Reed-Solomon buffer, after
+// correcting the given number of symbols.
+func (p *Parser) send(msgCh chan protocol.Message, idx, corrected int) {
+	var bits string
+	for _, symbol := range p.rsBuf[:16] {
+		bits += fmt.Sprintf("%05b", symbol)
+	}
+	for _, symbol := range p.rsBuf[26:] {
+		bits += fmt.Sprintf("%05b", symbol)
+	}
+
+	r900 := NewR900(protocol.Data{Idx: idx, Bits: bits})
+
+	msgCh <- protocol.Packet{Message: r900, Idx: idx, Corrected: corrected}
+}
+
+// R900 packets carry 21 5-bit symbols, 16 of data followed by 5 of
+// Reed-Solomon parity.
 type R900 struct {
 	ID          uint32 `xml:",attr"` // 32 bits
 	Unkn1       uint8  `xml:",attr"` // 8 bits
@@ -259,6 +315,75 @@ type R900 struct {
 	checksum    [5]byte
 }
 
+// Given the bits of a packet's symbols, make a message.
+func NewR900(data protocol.Data) (r900 R900) {
+	id, _ := strconv.ParseUint(data.Bits[:32], 2, 32)
+	unkn1, _ := strconv.ParseUint(data.Bits[32:40], 2, 8)
+	nouse, _ := strconv.ParseUint(data.Bits[40:46], 2, 6)
+	backflow, _ := strconv.ParseUint(data.Bits[46:48], 2, 2)
+	consumption, _ := strconv.ParseUint(data.Bits[48:72], 2, 24)
+	unkn3, _ := strconv.ParseUint(data.Bits[72:74], 2, 2)
+	leak, _ := strconv.ParseUint(data.Bits[74:78], 2, 4)
+	leaknow, _ := strconv.ParseUint(data.Bits[78:80], 2, 2)
+
+	r900.ID = uint32(id)
+	r900.Unkn1 = uint8(unkn1)
+	r900.NoUse = uint8(nouse)
+	r900.BackFlow = uint8(backflow)
+	r900.Consumption = uint32(consumption)
+	r900.Unkn3 = uint8(unkn3)
+	r900.Leak = uint8(leak)
+	r900.LeakNow = uint8(leaknow)
+
+	for idx := range r900.checksum {
+		offset := 80 + idx*5
+		symbol, _ := strconv.ParseUint(data.Bits[offset:offset+5], 2, 5)
+		r900.checksum[idx] = byte(symbol)
+	}
+
+	return
+}
+
+// Encode is the inverse of NewR900, it returns the bits of the message's
+// symbols. The parity symbols are calculated rather than taken from the
+// message.
+func (r900 R900) Encode() protocol.Data {
+	bits := fmt.Sprintf("%032b", r900.ID)
+	bits += fmt.Sprintf("%08b", r900.Unkn1)
+	bits += fmt.Sprintf("%06b", r900.NoUse&0x3F)
+	bits += fmt.Sprintf("%02b", r900.BackFlow&0x03)
+	bits += fmt.Sprintf("%024b", r900.Consumption&0xFFFFFF)
+	bits += fmt.Sprintf("%02b", r900.Unkn3&0x03)
+	bits += fmt.Sprintf("%04b", r900.Leak&0x0F)
+	bits += fmt.Sprintf("%02b", r900.LeakNow&0x03)
+
+	// The code is shortened, data symbols are followed by zeros in place of
+	// the 10 untransmitted symbols.
+	var rsBuf [26]byte
+	for idx := range rsBuf[:16] {
+		symbol, _ := strconv.ParseUint(bits[idx*5:idx*5+5], 2, 5)
+		rsBuf[idx] = byte(symbol)
+	}
+
+	for _, symbol := range field.Parity(rsBuf[:], 5, 29) {
+		bits += fmt.Sprintf("%05b", symbol)
+	}
+
+	return protocol.Data{Bits: bits, Bytes: protocol.PackBits(bits)}
+}
+
+// Digits returns the message's symbols as transmitted: a pair of base-6
+// digits per symbol, each digit four chips long.
+func (r900 R900) Digits() (digits string) {
+	bits := r900.Encode().Bits
+	for idx := 0; idx < len(bits); idx += 5 {
+		symbol, _ := strconv.ParseUint(bits[idx:idx+5], 2, 5)
+		digits += fmt.Sprintf("%02s", strconv.FormatUint(symbol, 6))
+	}
+
+	return
+}
+
 func (r900 R900) MsgType() string {
 	return "R900"
 }
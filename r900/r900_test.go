@@ -0,0 +1,67 @@
+package r900
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+const (
+	Trials = 512
+)
+
+// Encoded messages must have a zero syndrome and parse to the original.
+func TestRoundTrip(t *testing.T) {
+	for trial := 0; trial < Trials; trial++ {
+		r900 := R900{
+			ID:          rand.Uint32(),
+			Unkn1:       uint8(rand.Intn(256)),
+			NoUse:       uint8(rand.Intn(1 << 6)),
+			BackFlow:    uint8(rand.Intn(1 << 2)),
+			Consumption: rand.Uint32() & 0xFFFFFF,
+			Unkn3:       uint8(rand.Intn(1 << 2)),
+			Leak:        uint8(rand.Intn(1 << 4)),
+			LeakNow:     uint8(rand.Intn(1 << 2)),
+		}
+
+		data := r900.Encode()
+		if len(data.Bits) != 105 {
+			t.Fatalf("expected 105 bits, got %d", len(data.Bits))
+		}
+
+		var rsBuf [31]byte
+		for idx := 0; idx < 21; idx++ {
+			symbol, _ := strconv.ParseUint(data.Bits[idx*5:idx*5+5], 2, 5)
+			if idx < 16 {
+				rsBuf[idx] = byte(symbol)
+			} else {
+				rsBuf[idx+10] = byte(symbol)
+			}
+		}
+
+		if syndrome := field.Syndrome(rsBuf[:], 5, 29); !bytes.Equal(syndrome, make([]byte, 5)) {
+			t.Fatalf("%+v: non-zero syndrome %02X", r900, syndrome)
+		}
+
+		msg := NewR900(data)
+		r900.checksum = msg.checksum
+		if msg != r900 {
+			t.Fatalf("expected %+v, got %+v", r900, msg)
+		}
+
+		// Each symbol is a pair of base-6 digits.
+		digits := r900.Digits()
+		if len(digits) != PayloadSymbols {
+			t.Fatalf("expected %d digits, got %d", PayloadSymbols, len(digits))
+		}
+		for idx := 0; idx < len(digits); idx += 2 {
+			symbol, _ := strconv.ParseUint(digits[idx:idx+2], 6, 5)
+			bits := data.Bits[idx/2*5 : idx/2*5+5]
+			if fmt.Sprintf("%05b", symbol) != bits {
+				t.Fatalf("digits %s don't match symbol %s", digits[idx:idx+2], bits)
+			}
+		}
+	}
+}
@@ -59,12 +59,21 @@ func (p Parser) Parse(pkts []protocol.Data, msgCh chan protocol.Message, wg *syn
 	go p.Parser.Parse(pkts, localMsgCh, localWg)
 
 	for msg := range localMsgCh {
-		r900bcd := R900BCD{msg.(r900.R900)}
+		pkt := msg.(protocol.Packet)
+		r900bcd := R900BCD{pkt.Message.(r900.R900)}
 		hex := strconv.FormatUint(uint64(r900bcd.Consumption), 16)
 		consumption, _ := strconv.ParseUint(hex, 10, 32)
 		r900bcd.Consumption = uint32(consumption)
-		msgCh <- r900bcd
+		pkt.Message = r900bcd
+		msgCh <- pkt
 	}
 
 	wg.Done()
 }
+
+// Discard buffered signal of the underlying r900 parser.
+func (p Parser) Reset() {
+	if r, ok := p.Parser.(protocol.Resetter); ok {
+		r.Reset()
+	}
+}
@@ -0,0 +1,246 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bemasher/rtlamr/protocol"
+)
+
+var (
+	scan  = flag.String("scan", "", "retune through a comma-separated list of center frequencies in Hz in turn, start:stop:step gives a range")
+	dwell = flag.Duration("dwell", 30*time.Second, "time to listen on each frequency when scanning")
+
+	timeSlice = flag.Duration("timeslice", 0, "alternate between the center frequency each message type prefers, listening to each for this long and running only its message types, 0 tunes to a single frequency")
+
+	// Frequencies parsed from -scan.
+	scanFreqs []uint32
+)
+
+// Samples received just after retuning may still be from the previous
+// frequency, or from the tuner settling, and are discarded.
+const settleTime = 50 * time.Millisecond
+
+// Most frequencies a scan may list, keeps a range with a tiny step from
+// expanding to millions of them.
+const maxScanFreqs = 1000
+
+// Parses a comma-separated list of frequencies and start:stop:step ranges.
+func ParseScan(s string) (freqs []uint32, err error) {
+	for _, field := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(field), ":")
+		if len(parts) != 1 && len(parts) != 3 {
+			return nil, fmt.Errorf("invalid frequency or range: %q", field)
+		}
+
+		values := make([]uint64, len(parts))
+		for idx, part := range parts {
+			values[idx], err = strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("strconv.ParseUint: %w", err)
+			}
+		}
+
+		if len(values) == 1 {
+			freqs = append(freqs, uint32(values[0]))
+			continue
+		}
+
+		start, stop, step := values[0], values[1], values[2]
+		if step == 0 || stop < start {
+			return nil, fmt.Errorf("invalid range: %q", field)
+		}
+		if n := (stop-start)/step + 1; uint64(len(freqs))+n > maxScanFreqs {
+			return nil, fmt.Errorf("range %q exceeds %d frequencies", field, maxScanFreqs)
+		}
+		for freq := start; freq <= stop; freq += step {
+			freqs = append(freqs, uint32(freq))
+		}
+	}
+
+	if len(freqs) > maxScanFreqs {
+		return nil, fmt.Errorf("scan exceeds %d frequencies", maxScanFreqs)
+	}
+
+	return freqs, nil
+}
+
+// A Scan cycles a receiver through a list of center frequencies, dwelling
+// on each for a number of samples, and keeps statistics of the messages
+// heard on each. Advance is called by the goroutine reading samples, Add by
+// the one decoding them.
+type Scan struct {
+	name  string
+	freqs []uint32
+	idx   int
+
+	dwell, settle int // In samples.
+	remaining     int // Samples left to dwell on the current frequency.
+	discard       int // Samples left to discard after retuning.
+
+	sampleRate int
+
+	// Protocols decoded on each frequency when time slicing, all of them if
+	// nil.
+	protocols map[uint32][]string
+
+	mu    sync.Mutex
+	stats map[uint32]*scanStats
+}
+
+// Messages heard on a frequency.
+type scanStats struct {
+	samples  int // Listened to, excluding those discarded after retuning.
+	messages int
+	meters   map[string]bool
+}
+
+// Make a new scan through freqs at the given sample rate, dwelling on each
+// for the given period.
+func NewScan(name string, freqs []uint32, sampleRate int, dwell time.Duration) *Scan {
+	s := &Scan{
+		name:       name,
+		freqs:      freqs,
+		dwell:      int(dwell.Seconds() * float64(sampleRate)),
+		settle:     int(settleTime.Seconds() * float64(sampleRate)),
+		sampleRate: sampleRate,
+		stats:      map[uint32]*scanStats{},
+	}
+	s.remaining = s.dwell
+
+	for _, freq := range freqs {
+		s.stats[freq] = &scanStats{meters: map[string]bool{}}
+	}
+
+	return s
+}
+
+// Make a scan alternating between the center frequencies protocols prefer,
+// running only the protocols of each on it. Returns nil if they all prefer
+// the same frequency.
+func NewTimeSlice(name string, protocols map[uint32][]string, sampleRate int, slice time.Duration) *Scan {
+	if len(protocols) < 2 {
+		return nil
+	}
+
+	freqs := make([]uint32, 0, len(protocols))
+	for freq := range protocols {
+		freqs = append(freqs, freq)
+	}
+	slices.Sort(freqs)
+
+	s := NewScan(name, freqs, sampleRate, slice)
+	s.protocols = protocols
+
+	return s
+}
+
+// Returns the frequency currently tuned to.
+func (s *Scan) Freq() uint32 {
+	return s.freqs[s.idx]
+}
+
+// Advance the scan by the number of samples read at the current frequency.
+// Returns the next frequency and true once the dwell is over. Reports
+// whether the samples should be discarded as having been received while the
+// tuner was settling.
+func (s *Scan) Advance(samples int) (next uint32, retune, discard bool) {
+	if s.discard > 0 {
+		s.discard -= samples
+		return 0, false, true
+	}
+
+	s.mu.Lock()
+	s.stats[s.Freq()].samples += samples
+	s.mu.Unlock()
+
+	s.remaining -= samples
+	if s.remaining > 0 || len(s.freqs) == 1 {
+		return 0, false, false
+	}
+
+	s.idx = (s.idx + 1) % len(s.freqs)
+	s.remaining = s.dwell
+	s.discard = s.settle
+
+	// Log statistics after each pass through the frequencies.
+	if s.idx == 0 {
+		s.Log()
+	}
+
+	return s.Freq(), true, false
+}
+
+// Count a message heard on a frequency.
+func (s *Scan) Add(freq uint32, msg protocol.LogMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats, ok := s.stats[freq]
+	if !ok {
+		return
+	}
+
+	stats.messages++
+	stats.meters[fmt.Sprintf("%s:%d", msg.MsgType(), msg.MeterID())] = true
+}
+
+// Logs the time listened to each frequency and the messages heard on it.
+func (s *Scan) Log() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := 0
+	for _, stats := range s.stats {
+		total += stats.samples
+	}
+
+	for _, freq := range s.freqs {
+		stats := s.stats[freq]
+		listened := time.Duration(stats.samples) * time.Second / time.Duration(s.sampleRate)
+
+		var perMinute, airtime float64
+		if listened > 0 {
+			perMinute = math.Round(10*float64(stats.messages)/listened.Minutes()) / 10
+			airtime = 100 * float64(stats.samples) / float64(total)
+		}
+
+		attrs := []any{
+			"name", s.name,
+			"freq", freq,
+			"listened", listened.Round(time.Second),
+			"airtime", fmt.Sprintf("%.1f%%", airtime),
+			"messages", stats.messages,
+			"meters", len(stats.meters),
+			"per_minute", perMinute,
+		}
+		if s.protocols != nil {
+			attrs = append(attrs, "msgtypes", strings.Join(s.protocols[freq], ","))
+		}
+
+		slog.Info("scan", attrs...)
+	}
+}
@@ -0,0 +1,114 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseScan(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		freqs []uint32
+		err   bool
+	}{
+		{"912600155", []uint32{912600155}, false},
+		{"912600155,912380000", []uint32{912600155, 912380000}, false},
+		{"911000000:912000000:500000", []uint32{911000000, 911500000, 912000000}, false},
+		{"912380000,911000000:911400000:200000", []uint32{912380000, 911000000, 911200000, 911400000}, false},
+		{"", nil, true},
+		{"912000000:911000000:1000", nil, true},
+		{"911000000:912000000:0", nil, true},
+		{"911000000:912000000", nil, true},
+		{"5000000000", nil, true},
+		{"911000000:912000000:-1000", nil, true},
+		{"902000000:928000000:1", nil, true},
+		{"902000000:928000000:26000", nil, true},
+		{"902000000,902000000:928000000:26026", nil, true},
+	} {
+		freqs, err := ParseScan(tc.value)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: expected error %v, got %v", tc.value, tc.err, err)
+			continue
+		}
+		if !reflect.DeepEqual(freqs, tc.freqs) {
+			t.Errorf("%q: expected %d, got %d", tc.value, tc.freqs, freqs)
+		}
+	}
+}
+
+// The scan retunes after each dwell, discards samples while the tuner
+// settles and counts only the rest as listened to.
+func TestScanAdvance(t *testing.T) {
+	s := &Scan{
+		freqs:  []uint32{1, 2},
+		dwell:  100,
+		settle: 20,
+		stats: map[uint32]*scanStats{
+			1: {meters: map[string]bool{}},
+			2: {meters: map[string]bool{}},
+		},
+		sampleRate: 10,
+	}
+	s.remaining = s.dwell
+
+	var tuned []uint32
+	discarded := 0
+	for block := 0; block < 30; block++ {
+		next, retune, discard := s.Advance(10)
+		if discard {
+			discarded += 10
+		}
+		if retune {
+			tuned = append(tuned, next)
+		}
+	}
+
+	if want := []uint32{2, 1}; !reflect.DeepEqual(tuned, want) {
+		t.Errorf("expected retunes %d, got %d", want, tuned)
+	}
+	if discarded != 40 {
+		t.Errorf("expected 40 samples discarded, got %d", discarded)
+	}
+	if s.stats[1].samples != 160 || s.stats[2].samples != 100 {
+		t.Errorf("expected 160 and 100 samples listened, got %d and %d", s.stats[1].samples, s.stats[2].samples)
+	}
+}
+
+// Time slicing alternates between the frequencies protocols prefer, lowest
+// first, and isn't needed if they share one.
+func TestNewTimeSlice(t *testing.T) {
+	protocols := map[uint32][]string{
+		912600155: {"scm", "idm"},
+		912380000: {"r900"},
+	}
+
+	s := NewTimeSlice("", protocols, 2359296, time.Second)
+	if want := []uint32{912380000, 912600155}; !reflect.DeepEqual(s.freqs, want) {
+		t.Errorf("expected frequencies %d, got %d", want, s.freqs)
+	}
+	if s.dwell != 2359296 {
+		t.Errorf("expected dwell of 2359296 samples, got %d", s.dwell)
+	}
+
+	delete(protocols, 912380000)
+	if s := NewTimeSlice("", protocols, 2359296, time.Second); s != nil {
+		t.Errorf("expected no time slicing for a single frequency, got %d", s.freqs)
+	}
+}
@@ -19,6 +19,8 @@ package scm
 import (
 	"encoding/binary"
 	"fmt"
+	"slices"
+	"sort"
 	"strconv"
 	"sync"
 
@@ -30,15 +32,37 @@ func init() {
 	protocol.RegisterParser("scm", NewParser)
 }
 
+const preamble = "111110010101001100000"
+
+var bch = crc.NewCRC("BCH", 0, 0x6F63, 0)
+
+// The checksum covers the packet from its third byte, beginning with the
+// last bits of the preamble. Those are known, so are never corrected.
+const knownBits = len(preamble) - 16
+
+// Maximum number of bit errors corrected in each packet, zero disables
+// correction. The BCH code can correct up to 2, though each bit corrected
+// makes accepting a corrupt packet more likely.
+var MaxCorrection int
+
 type Parser struct {
 	crc.CRC
 	cfg  protocol.PacketConfig
 	data protocol.Data
+	d    *protocol.Decoder
+
+	syndromes crc.Syndromes
 }
 
 func NewParser(chipLength int) (p protocol.Parser) {
+	var syndromes crc.Syndromes
+	if MaxCorrection > 0 {
+		syndromes = bch.Syndromes(10, knownBits, MaxCorrection)
+	}
+
 	return &Parser{
-		CRC: crc.NewCRC("BCH", 0, 0x6F63, 0),
+		CRC:       bch,
+		syndromes: syndromes,
 		cfg: protocol.PacketConfig{
 			Protocol:        "scm",
 			CenterFreq:      912600155,
@@ -46,13 +70,15 @@ func NewParser(chipLength int) (p protocol.Parser) {
 			ChipLength:      chipLength,
 			PreambleSymbols: 21,
 			PacketSymbols:   96,
-			Preamble:        "111110010101001100000",
+			Preamble:        preamble,
 		},
 		data: protocol.Data{Bytes: make([]byte, 96>>3)},
 	}
 }
 
-func (p Parser) SetDecoder(d *protocol.Decoder) {}
+func (p *Parser) SetDecoder(d *protocol.Decoder) {
+	p.d = d
+}
 
 func (p *Parser) Cfg() protocol.PacketConfig {
 	return p.cfg
@@ -61,6 +87,15 @@ func (p *Parser) Cfg() protocol.PacketConfig {
 func (p Parser) Parse(pkts []protocol.Data, msgCh chan protocol.Message, wg *sync.WaitGroup) {
 	seen := make(map[string]bool)
 
+	// Packets failing the checksum are corrected once all intact packets
+	// are seen. Misaligned copies of a packet can often be corrected too,
+	// into garbage, so corrections overlapping an accepted packet are
+	// discarded.
+	var (
+		accepted []int
+		damaged  []correction
+	)
+
 	for _, pkt := range pkts {
 		p.data.Idx = pkt.Idx
 		p.data.Bits = pkt.Bits[0:p.cfg.PacketSymbols]
@@ -72,24 +107,73 @@ func (p Parser) Parse(pkts []protocol.Data, msgCh chan protocol.Message, wg *syn
 		}
 		seen[s] = true
 
-		// If the checksum fails, bail.
-		if p.Checksum(p.data.Bytes[2:12]) != 0 {
+		// If the checksum fails, bail unless it can be corrected.
+		syndrome := p.Syndrome(p.data.Bytes[2:12])
+		if syndrome != 0 {
+			if p.syndromes != nil {
+				damaged = append(damaged, correction{pkt, p.syndromes.Correct(nil, syndrome)})
+			}
+			continue
+		}
+
+		if p.send(msgCh, 0) {
+			accepted = append(accepted, pkt.Idx)
+		}
+	}
+
+	// Prefer the corrections flipping the fewest bits.
+	sort.SliceStable(damaged, func(i, j int) bool {
+		return damaged[i].bits < damaged[j].bits
+	})
+
+	packetLength := p.cfg.PacketSymbols * p.d.Cfg.SymbolLength
+	for _, c := range damaged {
+		if c.bits < 0 || slices.ContainsFunc(accepted, func(idx int) bool {
+			return c.pkt.Idx-idx < packetLength && idx-c.pkt.Idx < packetLength
+		}) {
 			continue
 		}
 
-		scm := NewSCM(p.data)
+		p.data.Idx = c.pkt.Idx
+		copy(p.data.Bytes, c.pkt.Bytes)
+		p.syndromes.Correct(p.data.Bytes[2:12], p.Syndrome(p.data.Bytes[2:12]))
 
-		// If the meter id is 0, bail.
-		if scm.ID == 0 {
+		s := string(p.data.Bytes)
+		if seen[s] {
 			continue
 		}
+		seen[s] = true
 
-		msgCh <- scm
+		p.data.Bits = protocol.NewData(p.data.Bytes).Bits
+		if p.send(msgCh, c.bits) {
+			accepted = append(accepted, c.pkt.Idx)
+		}
 	}
 
 	wg.Done()
 }
 
+// A packet which failed its checksum and the number of bits that would
+// correct it, -1 if it can't be.
+type correction struct {
+	pkt  protocol.Data
+	bits int
+}
+
+// Send the message in a packet which passed its checksum, after correcting
+// the given number of bits. Reports whether the message was sent.
+func (p Parser) send(msgCh chan protocol.Message, corrected int) bool {
+	scm := NewSCM(p.data)
+
+	// If the meter id is 0, bail.
+	if scm.ID == 0 {
+		return false
+	}
+
+	msgCh <- protocol.Packet{Message: scm, Idx: p.data.Idx, Corrected: corrected}
+	return true
+}
+
 // Standard Consumption Message
 type SCM struct {
 	ID          uint32 `xml:",attr"`
@@ -118,6 +202,24 @@ func NewSCM(data protocol.Data) (scm SCM) {
 	return
 }
 
+// Encode is the inverse of NewSCM, it returns the packet the message would be
+// parsed from. The checksum is calculated rather than taken from ChecksumVal.
+func (scm SCM) Encode() protocol.Data {
+	bits := preamble
+	bits += fmt.Sprintf("%02b", scm.ID>>24&0x03)
+	bits += "0"
+	bits += fmt.Sprintf("%02b", scm.TamperPhy&0x03)
+	bits += fmt.Sprintf("%04b", scm.Type&0x0F)
+	bits += fmt.Sprintf("%02b", scm.TamperEnc&0x03)
+	bits += fmt.Sprintf("%024b", scm.Consumption&0xFFFFFF)
+	bits += fmt.Sprintf("%024b", scm.ID&0xFFFFFF)
+
+	data := protocol.PackBits(bits + "0000000000000000")
+	binary.BigEndian.PutUint16(data[10:], bch.Checksum(data[2:10]))
+
+	return protocol.NewData(data)
+}
+
 func (scm SCM) MsgType() string {
 	return "SCM"
 }
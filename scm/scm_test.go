@@ -0,0 +1,107 @@
+package scm
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/bemasher/rtlamr/protocol"
+)
+
+const (
+	Trials = 512
+)
+
+// A parser registered with a decoder, as it would be in use.
+func newParser() protocol.Parser {
+	p := NewParser(72)
+	d := protocol.NewDecoder()
+	d.RegisterProtocol(p)
+	d.Allocate()
+	return p
+}
+
+// Encoded messages must pass the parser's checks and parse to the original.
+func TestRoundTrip(t *testing.T) {
+	p := newParser()
+
+	for trial := 0; trial < Trials; trial++ {
+		scm := SCM{
+			ID:          rand.Uint32()&0x3FFFFFF | 1,
+			Type:        uint8(rand.Intn(16)),
+			TamperPhy:   uint8(rand.Intn(4)),
+			TamperEnc:   uint8(rand.Intn(4)),
+			Consumption: rand.Uint32() & 0xFFFFFF,
+		}
+
+		data := scm.Encode()
+
+		pkt, ok := protocol.ParseData(p, data)
+		if !ok {
+			t.Fatalf("%+v: parser rejected %02X", scm, data.Bytes)
+		}
+		msg := pkt.Message
+
+		scm.ChecksumVal = msg.(SCM).ChecksumVal
+		if msg != scm {
+			t.Fatalf("expected %+v, got %+v", scm, msg)
+		}
+	}
+}
+
+func TestCorrection(t *testing.T) {
+	defer func(max int) { MaxCorrection = max }(MaxCorrection)
+	MaxCorrection = 2
+	p := newParser()
+
+	for trial := 0; trial < Trials; trial++ {
+		scm := SCM{
+			ID:          rand.Uint32()&0x3FFFFFF | 1,
+			Type:        uint8(rand.Intn(16)),
+			TamperPhy:   uint8(rand.Intn(4)),
+			TamperEnc:   uint8(rand.Intn(4)),
+			Consumption: rand.Uint32() & 0xFFFFFF,
+		}
+
+		data := scm.Encode()
+		scm.ChecksumVal = binary.BigEndian.Uint16(data.Bytes[10:])
+
+		// Flip one or two distinct bits following the preamble.
+		flips := rand.Intn(2) + 1
+		for _, bIdx := range rand.Perm(80 - knownBits)[:flips] {
+			bIdx += knownBits
+			data.Bytes[2+bIdx>>3] ^= 0x80 >> uint(bIdx&7)
+		}
+		data = protocol.NewData(data.Bytes)
+
+		pkt, ok := protocol.ParseData(p, data)
+		if !ok {
+			t.Fatalf("%+v: parser rejected %02X", scm, data.Bytes)
+		}
+
+		if pkt.Corrected != flips {
+			t.Fatalf("expected %d corrected bits, got %d", flips, pkt.Corrected)
+		}
+		if pkt.Message != scm {
+			t.Fatalf("expected %+v, got %+v", scm, pkt.Message)
+		}
+	}
+}
+
+// Errors in the known bits of the preamble aren't corrected.
+func TestCorrectionPreamble(t *testing.T) {
+	defer func(max int) { MaxCorrection = max }(MaxCorrection)
+	MaxCorrection = 2
+	p := newParser()
+
+	scm := SCM{ID: 12345678, Type: 7, Consumption: 1234}
+	for bIdx := 16; bIdx < len(preamble); bIdx++ {
+		data := scm.Encode()
+		data.Bytes[bIdx>>3] ^= 0x80 >> uint(bIdx&7)
+		data = protocol.NewData(data.Bytes)
+
+		if pkt, ok := protocol.ParseData(p, data); ok {
+			t.Fatalf("expected preamble bit %d not corrected, got %+v", bIdx, pkt.Message)
+		}
+	}
+}
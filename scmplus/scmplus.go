@@ -31,13 +31,20 @@ func init() {
 	protocol.RegisterParser("scm+", NewParser)
 }
 
+var ccitt = crc.NewCRC("CCITT", 0xFFFF, 0x1021, 0x1D0F)
+
 type Parser struct {
 	crc.CRC
 	cfg  protocol.PacketConfig
 	data protocol.Data
+
+	d        *protocol.Decoder
+	recovery *protocol.Recovery
 }
 
-func (p Parser) SetDecoder(d *protocol.Decoder) {}
+func (p *Parser) SetDecoder(d *protocol.Decoder) {
+	p.d = d
+}
 
 func (p *Parser) Cfg() protocol.PacketConfig {
 	return p.cfg
@@ -45,7 +52,7 @@ func (p *Parser) Cfg() protocol.PacketConfig {
 
 func NewParser(chipLength int) (p protocol.Parser) {
 	return &Parser{
-		CRC: crc.NewCRC("CCITT", 0xFFFF, 0x1021, 0x1D0F),
+		CRC: ccitt,
 		cfg: protocol.PacketConfig{
 			Protocol:        "scm+",
 			CenterFreq:      912600155,
@@ -55,13 +62,21 @@ func NewParser(chipLength int) (p protocol.Parser) {
 			PacketSymbols:   16 * 8,
 			Preamble:        "0001011010100011",
 		},
-		data: protocol.Data{Bytes: make([]byte, 16)},
+		data:     protocol.Data{Bytes: make([]byte, 16)},
+		recovery: protocol.NewRecovery(ccitt, 16*8, 2, 16),
 	}
 }
 
 func (p Parser) Parse(pkts []protocol.Data, msgCh chan protocol.Message, wg *sync.WaitGroup) {
 	seen := make(map[string]bool)
 
+	// Packets failing the checksum are recovered once intact packets are
+	// parsed.
+	var (
+		accepted []int
+		damaged  []protocol.Data
+	)
+
 	for _, pkt := range pkts {
 		p.data.Idx = pkt.Idx
 		p.data.Bits = pkt.Bits[0:p.cfg.PacketSymbols]
@@ -73,24 +88,38 @@ func (p Parser) Parse(pkts []protocol.Data, msgCh chan protocol.Message, wg *syn
 		}
 		seen[s] = true
 
-		// If the checksum fails, bail.
+		// If the checksum fails, bail unless it can be recovered.
 		if residue := p.Checksum(p.data.Bytes[2:]); residue != p.Residue {
+			damaged = append(damaged, pkt)
 			continue
 		}
 
-		scm := NewSCM(p.data)
-
-		// If the EndpointID is 0 or ProtocolID is invalid, bail.
-		if scm.EndpointID == 0 || scm.ProtocolID != 0x1E {
-			continue
+		if p.send(p.data, msgCh, 0) {
+			accepted = append(accepted, pkt.Idx)
 		}
-
-		msgCh <- scm
 	}
 
+	p.recovery.Recover(p.d, damaged, accepted, func(data protocol.Data, flipped int) bool {
+		return p.send(data, msgCh, flipped)
+	})
+
 	wg.Done()
 }
 
+// Send the message in a packet which passed its checksum, after flipping
+// the given number of bits. Reports whether the message was sent.
+func (p Parser) send(data protocol.Data, msgCh chan protocol.Message, flipped int) bool {
+	scm := NewSCM(data)
+
+	// If the EndpointID is 0 or ProtocolID is invalid, bail.
+	if scm.EndpointID == 0 || scm.ProtocolID != 0x1E {
+		return false
+	}
+
+	msgCh <- protocol.Packet{Message: scm, Idx: data.Idx, Corrected: flipped}
+	return true
+}
+
 // Standard Consumption Message Plus
 type SCM struct {
 	FrameSync    uint16 `xml:",attr"`
@@ -99,7 +128,7 @@ type SCM struct {
 	EndpointID   uint32 `xml:",attr"`
 	Consumption  uint32 `xml:",attr"`
 	Tamper       uint16 `xml:",attr"`
-	PacketCRC    uint16 `xml:"Checksum,attr",json:"Checksum"`
+	PacketCRC    uint16 `xml:"Checksum,attr"`
 }
 
 func NewSCM(data protocol.Data) (scm SCM) {
@@ -108,6 +137,18 @@ func NewSCM(data protocol.Data) (scm SCM) {
 	return
 }
 
+// Encode is the inverse of NewSCM, it returns the packet the message would be
+// parsed from. The checksum is calculated rather than taken from PacketCRC.
+func (scm SCM) Encode() protocol.Data {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, scm)
+
+	data := buf.Bytes()
+	binary.BigEndian.PutUint16(data[14:], ^ccitt.Checksum(data[2:14]))
+
+	return protocol.NewData(data)
+}
+
 func (scm SCM) MsgType() string {
 	return "SCM+"
 }
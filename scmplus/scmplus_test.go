@@ -0,0 +1,41 @@
+package scmplus
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/bemasher/rtlamr/protocol"
+)
+
+const (
+	Trials = 512
+)
+
+// Encoded messages must pass the parser's checks and parse to the original.
+func TestRoundTrip(t *testing.T) {
+	p := NewParser(72)
+
+	for trial := 0; trial < Trials; trial++ {
+		scm := SCM{
+			FrameSync:    0x16A3,
+			ProtocolID:   0x1E,
+			EndpointType: uint8(rand.Intn(256)),
+			EndpointID:   rand.Uint32() | 1,
+			Consumption:  rand.Uint32(),
+			Tamper:       uint16(rand.Intn(1 << 16)),
+		}
+
+		data := scm.Encode()
+
+		pkt, ok := protocol.ParseData(p, data)
+		if !ok {
+			t.Fatalf("%+v: parser rejected %02X", scm, data.Bytes)
+		}
+		msg := pkt.Message
+
+		scm.PacketCRC = msg.(SCM).PacketCRC
+		if msg != scm {
+			t.Fatalf("expected %+v, got %+v", scm, msg)
+		}
+	}
+}
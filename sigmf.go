@@ -0,0 +1,186 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/protocol"
+)
+
+const (
+	SigMFVersion  = "1.0.0"
+	SigMFDataExt  = ".sigmf-data"
+	SigMFMetaExt  = ".sigmf-meta"
+	SigMFRecorder = "rtlamr"
+)
+
+// Maps -sampleformat values to SigMF datatypes.
+var sigmfDatatypes = map[string]string{
+	"cu8":  "cu8",
+	"cs8":  "ci8",
+	"cs16": "ci16_le",
+	"cf32": "cf32_le",
+}
+
+// SigMF metadata describing a -samplefile capture. The sample file only
+// contains the sample buffers surrounding decoded messages, so each buffer
+// written is recorded as a separate capture segment.
+//
+// See https://github.com/sigmf/SigMF/blob/main/sigmf-spec.md
+type SigMF struct {
+	Global      SigMFGlobal       `json:"global"`
+	Captures    []SigMFCapture    `json:"captures"`
+	Annotations []SigMFAnnotation `json:"annotations"`
+
+	filename   string
+	sampleSize int
+}
+
+type SigMFGlobal struct {
+	Datatype   string           `json:"core:datatype"`
+	SampleRate float64          `json:"core:sample_rate"`
+	Version    string           `json:"core:version"`
+	Dataset    string           `json:"core:dataset,omitempty"`
+	Recorder   string           `json:"core:recorder"`
+	Hardware   string           `json:"core:hw,omitempty"`
+	Extensions []SigMFExtension `json:"core:extensions"`
+}
+
+type SigMFExtension struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Optional bool   `json:"optional"`
+}
+
+type SigMFCapture struct {
+	SampleStart int64   `json:"core:sample_start"`
+	Frequency   float64 `json:"core:frequency"`
+	Datetime    string  `json:"core:datetime"`
+}
+
+type SigMFAnnotation struct {
+	SampleStart int64  `json:"core:sample_start"`
+	SampleCount int64  `json:"core:sample_count"`
+	Label       string `json:"core:label"`
+	Comment     string `json:"core:comment,omitempty"`
+
+	Protocol  string `json:"rtlamr:protocol"`
+	MeterID   uint32 `json:"rtlamr:meter_id"`
+	MeterType uint8  `json:"rtlamr:meter_type"`
+
+	RSSI  float64 `json:"rtlamr:rssi"`
+	Noise float64 `json:"rtlamr:noise"`
+	SNR   float64 `json:"rtlamr:snr"`
+
+	FreqOffset float64 `json:"rtlamr:freq_offset"`
+
+	// Edges of the channel the message was heard on, if channelized.
+	FreqLowerEdge float64 `json:"core:freq_lower_edge,omitempty"`
+	FreqUpperEdge float64 `json:"core:freq_upper_edge,omitempty"`
+}
+
+// Given the name of a sample file, make a SigMF metadata file to accompany
+// it. Sample files not named *.sigmf-data are referenced as a non-conforming
+// dataset.
+func NewSigMF(sampleFilename string) *SigMF {
+	meta := &SigMF{
+		Global: SigMFGlobal{
+			Version:  SigMFVersion,
+			Recorder: SigMFRecorder,
+			Extensions: []SigMFExtension{
+				{Name: SigMFRecorder, Version: SigMFVersion, Optional: true},
+			},
+		},
+		Captures:    []SigMFCapture{},
+		Annotations: []SigMFAnnotation{},
+	}
+
+	if strings.HasSuffix(sampleFilename, SigMFDataExt) {
+		meta.filename = strings.TrimSuffix(sampleFilename, SigMFDataExt) + SigMFMetaExt
+	} else {
+		meta.filename = strings.TrimSuffix(sampleFilename, filepath.Ext(sampleFilename)) + SigMFMetaExt
+		meta.Global.Dataset = filepath.Base(sampleFilename)
+	}
+
+	return meta
+}
+
+// Sets global fields from the decoder's configuration and a description of
+// the sample source's hardware.
+func (meta *SigMF) Configure(cfg protocol.PacketConfig, hardware string) {
+	meta.Global.Datatype = sigmfDatatypes[cfg.SampleFormat]
+	meta.Global.SampleRate = float64(cfg.SampleRate)
+	meta.Global.Hardware = hardware
+	meta.sampleSize = cfg.SampleSize
+}
+
+// Records a segment of samples written at the given byte offset, length bytes
+// long, received at center frequency freq, whose last sample was received at
+// t.
+func (meta *SigMF) Capture(offset int64, length int, freq uint32, t time.Time) {
+	samples := int64(length / meta.sampleSize)
+	start := t.Add(-time.Duration(samples) * time.Second / time.Duration(meta.Global.SampleRate))
+
+	meta.Captures = append(meta.Captures, SigMFCapture{
+		SampleStart: offset / int64(meta.sampleSize),
+		Frequency:   float64(freq),
+		Datetime:    start.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// Records an annotation spanning count samples from start, those a message
+// was decoded from.
+func (meta *SigMF) Annotate(msg protocol.LogMessage, start, count int64) {
+	var lower, upper float64
+	if msg.Frequency != 0 {
+		lower = float64(msg.Frequency) - protocol.ChannelWidth/2
+		upper = float64(msg.Frequency) + protocol.ChannelWidth/2
+	}
+
+	meta.Annotations = append(meta.Annotations, SigMFAnnotation{
+		SampleStart: start,
+		SampleCount: count,
+		Label:       fmt.Sprintf("%s %d", msg.MsgType(), msg.MeterID()),
+		Comment:     fmt.Sprint(msg.Message),
+		Protocol:    msg.MsgType(),
+		MeterID:     msg.MeterID(),
+		MeterType:   msg.MeterType(),
+		RSSI:        msg.RSSI,
+		Noise:       msg.Noise,
+		SNR:         msg.SNR,
+		FreqOffset:  msg.FreqOffset,
+
+		FreqLowerEdge: lower,
+		FreqUpperEdge: upper,
+	})
+}
+
+// Writes the metadata file.
+func (meta *SigMF) Close() error {
+	buf, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent: %w", err)
+	}
+
+	return os.WriteFile(meta.filename, append(buf, '\n'), 0644)
+}
@@ -0,0 +1,112 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sim
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/netidm"
+	"github.com/bemasher/rtlamr/r900"
+	"github.com/bemasher/rtlamr/scm"
+	"github.com/bemasher/rtlamr/scmplus"
+)
+
+// Given a meter, return the on-off keyed chips of its next packet.
+func Chips(m Meter) ([]byte, error) {
+	switch m.Protocol {
+	case "scm":
+		msg := scm.SCM{
+			ID:          m.ID,
+			Type:        m.Type,
+			Consumption: m.Consumption,
+		}
+		return Manchester(msg.Encode().Bytes), nil
+	case "scm+":
+		msg := scmplus.SCM{
+			FrameSync:    0x16A3,
+			ProtocolID:   0x1E,
+			EndpointType: m.Type,
+			EndpointID:   m.ID,
+			Consumption:  m.Consumption,
+		}
+		return Manchester(msg.Encode().Bytes), nil
+	case "idm":
+		msg := idm.IDM{
+			Preamble:             0x555516A3,
+			PacketTypeID:         0x1C,
+			PacketLength:         0x5C,
+			ERTType:              m.Type,
+			ERTSerialNumber:      m.ID,
+			LastConsumptionCount: m.Consumption,
+		}
+		return Manchester(msg.Encode().Bytes), nil
+	case "netidm":
+		msg := netidm.NetIDM{
+			Preamble:        0x555516A3,
+			ProtocolID:      0x1C,
+			PacketLength:    0x5C,
+			ERTType:         m.Type,
+			ERTSerialNumber: m.ID,
+			LastConsumption: m.Consumption,
+		}
+		return Manchester(msg.Encode().Bytes), nil
+	case "r900":
+		msg := r900.R900{
+			ID:          m.ID,
+			Unkn1:       m.Type,
+			Consumption: m.Consumption,
+		}
+		return r900Chips(msg), nil
+	}
+
+	return nil, fmt.Errorf("sim: invalid protocol: %q", m.Protocol)
+}
+
+// Manchester encodes each bit of data, most significant first. Ones are
+// transmitted as on-off and zeros as off-on.
+func Manchester(data []byte) (chips []byte) {
+	chips = make([]byte, 0, len(data)<<4)
+	for _, b := range data {
+		for bIdx := 7; bIdx >= 0; bIdx-- {
+			bit := (b >> uint(bIdx)) & 1
+			chips = append(chips, bit, bit^1)
+		}
+	}
+	return chips
+}
+
+// Chips of each base-6 digit of an R900 payload.
+var r900Digits = [6][4]byte{
+	{0, 0, 1, 1}, {0, 1, 0, 1}, {0, 1, 1, 0},
+	{1, 1, 0, 0}, {1, 0, 1, 0}, {1, 0, 0, 1},
+}
+
+// R900 packets are a Manchester coded preamble followed by the message's
+// base-6 digits.
+func r900Chips(msg r900.R900) []byte {
+	preamble := make([]byte, 4)
+	binary.BigEndian.PutUint32(preamble, 0x0000E564)
+	chips := Manchester(preamble)
+
+	for _, digit := range msg.Digits() {
+		chips = append(chips, r900Digits[digit-'0'][:]...)
+	}
+
+	return chips
+}
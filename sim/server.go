@@ -0,0 +1,129 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sim
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Command constants defined in rtl_tcp.c
+const (
+	cmdCenterFreq = 1
+	cmdSampleRate = 2
+
+	cmdFreqCorrection = 5
+)
+
+// Dongle info sent by rtl_tcp when a client connects: an R820T with 29 gain
+// settings.
+var dongleInfo = struct {
+	Magic     [4]byte
+	Tuner     uint32
+	GainCount uint32
+}{[4]byte{'R', 'T', 'L', '0'}, 5, 29}
+
+// Size of each write to a client in bytes.
+const blockSize = 16384
+
+// A Server speaks the rtl_tcp protocol, streaming synthesized samples to
+// each client. Center frequency, sample rate and frequency correction
+// commands retune the client's generator, all other commands are ignored.
+type Server struct {
+	Config Config
+	Meters []Meter
+
+	// Pace samples at the sample rate rather than as fast as the client reads.
+	Realtime bool
+}
+
+// Accept connections on the listener and serve each in a new goroutine.
+// Returns when the listener is closed.
+func (s *Server) Serve(l net.Listener) error {
+	if _, err := NewGenerator(s.Config, s.Meters); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := s.ServeConn(conn); err != nil {
+				log.Printf("sim: %s: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Serve a single client until it disconnects.
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	g, err := NewGenerator(s.Config, s.Meters)
+	if err != nil {
+		return err
+	}
+
+	if err := binary.Write(conn, binary.BigEndian, dongleInfo); err != nil {
+		return fmt.Errorf("binary.Write: %w", err)
+	}
+
+	go handleCommands(conn, g)
+
+	block := make([]byte, blockSize)
+	start := time.Now()
+	var sent int64
+	for {
+		n, _ := g.Read(block)
+		if _, err := conn.Write(block[:n]); err != nil {
+			// Client disconnected.
+			return nil
+		}
+		sent += int64(n >> 1)
+
+		if rate := g.sampleRate.Load(); s.Realtime && rate != 0 {
+			due := start.Add(time.Duration(sent) * time.Second / time.Duration(rate))
+			time.Sleep(time.Until(due))
+		}
+	}
+}
+
+// Reads commands from the client until it disconnects.
+func handleCommands(r io.Reader, g *Generator) {
+	var cmd struct {
+		Command   uint8
+		Parameter uint32
+	}
+
+	for binary.Read(r, binary.BigEndian, &cmd) == nil {
+		switch cmd.Command {
+		case cmdCenterFreq:
+			g.SetCenterFreq(cmd.Parameter)
+		case cmdSampleRate:
+			g.SetSampleRate(cmd.Parameter)
+		case cmdFreqCorrection:
+			g.SetFreqCorrection(int32(cmd.Parameter))
+		}
+	}
+}
@@ -0,0 +1,328 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package sim synthesizes IQ samples containing meter transmissions, for
+// testing the receiver without a dongle.
+package sim
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/bemasher/rtlamr/protocol"
+)
+
+const (
+	// Chip rate of all supported protocols.
+	ChipRate = 32768
+
+	// Full scale of signal plus three standard deviations of noise, keeps
+	// synthesized cu8 samples from clipping.
+	FullScale = 100
+)
+
+// Config describes the synthesized signal.
+type Config struct {
+	SampleRate int     // Samples per second.
+	CenterFreq uint32  // Frequency the receiver is tuned to.
+	SNR        float64 // Signal to noise ratio of each packet in dB.
+	FreqOffset float64 // Carrier offset in Hz added to each packet.
+	PPM        float64 // Error of the receiver's oscillator in ppm.
+	ClockPPM   float64 // Error of each meter's chip clock in ppm.
+	Interval   time.Duration
+	Seed       int64
+
+	// Meters hop between this many channels protocol.ChannelWidth apart,
+	// centered on their protocol's carrier, transmitting each packet on one
+	// at random.
+	Hop int
+
+	// Impulses per second, such as switching power supplies and LED drivers
+	// emit, each two samples at full scale with random phase.
+	Impulses float64
+
+	// A continuous carrier interfering with packets, offset this many Hz from
+	// the receiver's center frequency, zero for none, and its power in dB
+	// relative to the noise.
+	Interferer, InterfererLevel float64
+
+	// Power in dB relative to the noise of a DC offset added to every sample,
+	// as a dongle's leaking local oscillator adds, zero for none.
+	DC float64
+
+	// Fraction of packets a neighbouring meter of the same protocol collides
+	// with, its packet starting at a random point before or after the start
+	// of the other, and its power in dB relative to the other's.
+	Collisions, CollisionLevel float64
+}
+
+// A Meter periodically transmits packets of a single protocol.
+type Meter struct {
+	Protocol    string // One of scm, scm+, idm, netidm or r900.
+	ID          uint32
+	Type        uint8
+	Consumption uint32
+}
+
+// A Generator produces an endless stream of cu8 samples containing noise
+// and packets transmitted by each meter in turn.
+type Generator struct {
+	cfg        Config
+	meters     []Meter
+	centerFreq atomic.Uint32
+	sampleRate atomic.Uint32
+	correction atomic.Int32
+	rng        *rand.Rand
+
+	noise, amplitude float64
+
+	sampleIdx int // Index of the next sample produced.
+	impulse   int // Samples left of the impulse being emitted.
+	impulsePh complex128
+	nextIdx   int // Index of the first sample of the next packet.
+	meterIdx  int
+
+	// Packets being transmitted, or waiting to be.
+	tx []*transmission
+
+	// Interfering carrier, rotated each sample.
+	interferer, interfererRot complex128
+
+	dc complex128
+}
+
+// A transmission is a packet's chips keyed on a carrier.
+type transmission struct {
+	chips     []byte
+	start     int     // Index of the packet's first sample.
+	pktRate   float64 // Chips per sample.
+	amplitude float64
+	rot       complex128
+	phase     complex128
+}
+
+// Make a new generator transmitting from the given meters.
+func NewGenerator(cfg Config, meters []Meter) (*Generator, error) {
+	for _, m := range meters {
+		if _, err := Chips(m); err != nil {
+			return nil, err
+		}
+	}
+
+	g := &Generator{
+		cfg:    cfg,
+		meters: append([]Meter(nil), meters...),
+		rng:    rand.New(rand.NewSource(cfg.Seed)),
+	}
+	g.centerFreq.Store(cfg.CenterFreq)
+	g.sampleRate.Store(uint32(cfg.SampleRate))
+
+	// Scale signal and noise so that their sum stays within FullScale.
+	// A neighbour's packet may add to a packet's amplitude.
+	ratio := math.Pow(10, cfg.SNR/20)
+	g.noise = FullScale / (ratio*(1+neighbourLevel(cfg)) + 3)
+	g.amplitude = ratio * g.noise
+
+	if cfg.Interferer != 0 {
+		g.interferer = complex(g.noise*math.Pow(10, cfg.InterfererLevel/20), 0)
+		g.interfererRot = cmplxExp(2 * math.Pi * cfg.Interferer / float64(cfg.SampleRate))
+	}
+
+	if cfg.DC != 0 {
+		g.dc = cmplxExp(math.Pi/4) * complex(g.noise*math.Pow(10, cfg.DC/20), 0)
+	}
+
+	g.nextIdx = g.intervalSamples()
+	if g.nextIdx <= 0 {
+		return nil, fmt.Errorf("sim: interval too short: %s", cfg.Interval)
+	}
+
+	return g, nil
+}
+
+// Retune the receiver, packets from meters transmitting outside of the
+// sampled bandwidth are lost.
+func (g *Generator) SetCenterFreq(freq uint32) {
+	g.centerFreq.Store(freq)
+}
+
+// Change the sample rate, takes effect from the next packet.
+func (g *Generator) SetSampleRate(rate uint32) {
+	g.sampleRate.Store(rate)
+}
+
+// Set the receiver's frequency correction in ppm, offsetting its
+// oscillator's error.
+func (g *Generator) SetFreqCorrection(ppm int32) {
+	g.correction.Store(ppm)
+}
+
+func (g *Generator) intervalSamples() int {
+	return int(g.cfg.Interval.Seconds() * float64(g.sampleRate.Load()))
+}
+
+// Carrier offset of a neighbour's packet from the packet it collides with is
+// random up to this many Hz either way, as meters' oscillators differ.
+const neighbourSpread = 8e3
+
+// Amplitude of a neighbour's packet relative to the packet it collides with,
+// zero without collisions.
+func neighbourLevel(cfg Config) float64 {
+	if cfg.Collisions <= 0 {
+		return 0
+	}
+	return math.Pow(10, cfg.CollisionLevel/20)
+}
+
+// Start transmitting the next meter's packet.
+func (g *Generator) transmit() {
+	m := &g.meters[g.meterIdx]
+	g.meterIdx = (g.meterIdx + 1) % len(g.meters)
+
+	chips, _ := Chips(*m)
+	sampleRate := float64(g.sampleRate.Load())
+	pktRate := ChipRate * (1 + g.cfg.ClockPPM*1e-6) / sampleRate
+	m.Consumption++
+
+	// Carrier offset relative to the receiver's center frequency. A fast
+	// oscillator tunes the receiver above the requested frequency.
+	centerFreq := float64(g.centerFreq.Load())
+	ppm := g.cfg.PPM - float64(g.correction.Load())
+	offset := float64(TransmitFreq(m.Protocol)) - centerFreq*(1+ppm*1e-6) + g.cfg.FreqOffset
+	if g.cfg.Hop > 1 {
+		channel := float64(g.rng.Intn(g.cfg.Hop)) - float64(g.cfg.Hop-1)/2
+		offset += channel * protocol.ChannelWidth
+	}
+	if math.Abs(offset) >= sampleRate/2 {
+		return
+	}
+
+	pkt := &transmission{
+		chips:     chips,
+		start:     g.sampleIdx,
+		pktRate:   pktRate,
+		amplitude: g.amplitude,
+		rot:       cmplxExp(2 * math.Pi * offset / sampleRate),
+		phase:     cmplxExp(2 * math.Pi * g.rng.Float64()),
+	}
+	g.tx = append(g.tx, pkt)
+
+	if g.cfg.Collisions <= 0 || g.rng.Float64() >= g.cfg.Collisions {
+		return
+	}
+
+	// The neighbour's meter differs only by its ID.
+	n := *m
+	n.ID++
+	chips, _ = Chips(n)
+
+	offset += (2*g.rng.Float64() - 1) * neighbourSpread
+	neighbour := &transmission{
+		chips:     chips,
+		start:     g.sampleIdx,
+		pktRate:   pktRate,
+		amplitude: g.amplitude * neighbourLevel(g.cfg),
+		rot:       cmplxExp(2 * math.Pi * offset / sampleRate),
+		phase:     cmplxExp(2 * math.Pi * g.rng.Float64()),
+	}
+	g.tx = append(g.tx, neighbour)
+
+	// Either packet may start first.
+	delay := g.rng.Intn(int(float64(len(chips)) / pktRate))
+	if g.rng.Intn(2) == 0 {
+		neighbour.start += delay
+	} else {
+		pkt.start += delay
+	}
+}
+
+// Read fills p with interleaved cu8 samples.
+func (g *Generator) Read(p []byte) (n int, err error) {
+	if len(g.meters) == 0 {
+		return 0, fmt.Errorf("sim: no meters")
+	}
+
+	for idx := 0; idx+1 < len(p); idx += 2 {
+		if g.sampleIdx == g.nextIdx {
+			g.transmit()
+			g.nextIdx += g.intervalSamples()
+		}
+
+		re := g.rng.NormFloat64() * g.noise / math.Sqrt2
+		im := g.rng.NormFloat64() * g.noise / math.Sqrt2
+
+		if g.cfg.Impulses > 0 && g.impulse == 0 && g.rng.Float64() < g.cfg.Impulses/float64(g.sampleRate.Load()) {
+			g.impulse = 2
+			g.impulsePh = cmplxExp(2 * math.Pi * g.rng.Float64())
+		}
+		if g.impulse > 0 {
+			re += 127.5 * real(g.impulsePh)
+			im += 127.5 * imag(g.impulsePh)
+			g.impulse--
+		}
+
+		re += real(g.interferer) + real(g.dc)
+		im += imag(g.interferer) + imag(g.dc)
+		g.interferer *= g.interfererRot
+
+		tx := g.tx[:0]
+		for _, t := range g.tx {
+			if g.sampleIdx < t.start {
+				tx = append(tx, t)
+				continue
+			}
+
+			chipIdx := int(float64(g.sampleIdx-t.start) * t.pktRate)
+			if chipIdx >= len(t.chips) {
+				continue
+			}
+			if t.chips[chipIdx] == 1 {
+				re += t.amplitude * real(t.phase)
+				im += t.amplitude * imag(t.phase)
+			}
+			t.phase *= t.rot
+			tx = append(tx, t)
+		}
+		g.tx = tx
+
+		p[idx] = quantize(re)
+		p[idx+1] = quantize(im)
+		g.sampleIdx++
+		n += 2
+	}
+
+	return n, nil
+}
+
+func quantize(v float64) byte {
+	return byte(math.Max(0, math.Min(255, math.Round(127.5+v))))
+}
+
+func cmplxExp(theta float64) complex128 {
+	return complex(math.Cos(theta), math.Sin(theta))
+}
+
+// The frequency a protocol's meters transmit on, as given by its parser.
+func TransmitFreq(name string) uint32 {
+	p, err := protocol.NewParser(name, 1)
+	if err != nil {
+		return 0
+	}
+	return p.Cfg().CenterFreq
+}
@@ -0,0 +1,207 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sim
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/protocol"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+var testMeters = []Meter{
+	{Protocol: "scm", ID: 12345678, Type: 12, Consumption: 1000},
+	{Protocol: "idm", ID: 34567890, Type: 8, Consumption: 3000},
+}
+
+// Samples per chip of the seeded generator's samples.
+const seedChipLength = 32
+
+// Generate seconds of samples from a seeded generator near the sensitivity
+// limit, with meters whose clocks and carriers are off.
+func seedSamples(seed int64, seconds float64) []byte {
+	g, err := NewGenerator(Config{
+		SampleRate: ChipRate * seedChipLength,
+		CenterFreq: 912600155,
+		SNR:        0,
+		FreqOffset: 5000,
+		ClockPPM:   100,
+		Interval:   50 * time.Millisecond,
+		Seed:       seed,
+	}, testMeters)
+	if err != nil {
+		panic(err)
+	}
+
+	samples := make([]byte, int(seconds*ChipRate*seedChipLength)<<1)
+	if _, err := io.ReadFull(g, samples); err != nil {
+		panic(err)
+	}
+	return samples
+}
+
+// Decode a seeded generator's samples. Returns the distinct messages decoded
+// from the meters transmitting, corrupt packets accepted are ignored.
+func decodeSeed(samples []byte, configure func(*protocol.Decoder)) map[string]bool {
+	// Parsers read their options when made.
+	d := protocol.NewDecoder()
+	d.Cfg.ChipLength = seedChipLength
+	configure(&d)
+	for _, m := range testMeters {
+		p, err := protocol.NewParser(m.Protocol, seedChipLength)
+		if err != nil {
+			panic(err)
+		}
+		d.RegisterProtocol(p)
+	}
+	d.Allocate()
+
+	ids := map[uint32]bool{}
+	for _, m := range testMeters {
+		ids[m.ID] = true
+	}
+
+	found := map[string]bool{}
+	for idx := 0; idx+d.Cfg.BlockSize2 <= len(samples); idx += d.Cfg.BlockSize2 {
+		for msg := range d.Decode(samples[idx : idx+d.Cfg.BlockSize2]) {
+			msg := msg.(protocol.Packet).Message
+			if ids[msg.MeterID()] {
+				found[fmt.Sprintf("%s %s", msg.MsgType(), strings.Join(msg.Record(), ","))] = true
+			}
+		}
+	}
+
+	return found
+}
+
+// Number of SCM and IDM messages found.
+func counts(found map[string]bool) (scm, idm int) {
+	for msg := range found {
+		if strings.HasPrefix(msg, "SCM ") {
+			scm++
+		} else {
+			idm++
+		}
+	}
+	return scm, idm
+}
+
+// Each option improving sensitivity decodes every packet of a fixed seed's
+// samples that decoding without it does, and without any of them at least
+// as many as the baseline decoder did before they were added.
+func TestDecodeSeed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("decodes seconds of samples for each seed and option")
+	}
+
+	// SCM and IDM messages the baseline decoder found in the first three
+	// seconds of samples of each seed.
+	baseline := map[int64][2]int{
+		1: {27, 2},
+		2: {27, 1},
+		3: {29, 3},
+	}
+
+	defer func(correction, flips int) {
+		scm.MaxCorrection, protocol.MaxFlips = correction, flips
+	}(scm.MaxCorrection, protocol.MaxFlips)
+
+	options := []struct {
+		name      string
+		configure func(*protocol.Decoder)
+	}{
+		{"scmcorrect", func(*protocol.Decoder) { scm.MaxCorrection = 2 }},
+		{"maxflips", func(*protocol.Decoder) { protocol.MaxFlips = 2 }},
+		{"preamblethreshold", func(d *protocol.Decoder) { d.Cfg.PreambleThreshold = 0.8 }},
+		{"timingrecovery", func(d *protocol.Decoder) { d.Cfg.TimingRecovery = true }},
+		{"iqcorrection", func(d *protocol.Decoder) { d.Cfg.IQCorrection = true }},
+	}
+
+	for seed, want := range baseline {
+		samples := seedSamples(seed, 3)
+		found := decodeSeed(samples, func(*protocol.Decoder) {})
+		scmFound, idmFound := counts(found)
+		if scmFound < want[0] || idmFound < want[1] {
+			t.Errorf("seed %d: expected at least the baseline's %d SCM and %d IDM messages, got %d and %d", seed, want[0], want[1], scmFound, idmFound)
+		}
+
+		for _, o := range options {
+			got := decodeSeed(samples, func(d *protocol.Decoder) {
+				scm.MaxCorrection, protocol.MaxFlips = 0, 0
+				o.configure(d)
+			})
+			scm.MaxCorrection, protocol.MaxFlips = 0, 0
+
+			for msg := range found {
+				if !got[msg] {
+					t.Errorf("seed %d: -%s lost %s", seed, o.name, msg)
+				}
+			}
+			scmGot, idmGot := counts(got)
+			t.Logf("seed %d: -%s decoded %d SCM and %d IDM messages, %d and %d without", seed, o.name, scmGot, idmGot, scmFound, idmFound)
+		}
+	}
+}
+
+// Decode blocks of noise alone, as most blocks are, with every message type
+// -msgtype all enables.
+func benchmarkDecode(b *testing.B, gate bool) {
+	const chipLength = 72
+
+	d := protocol.NewDecoder()
+	d.Cfg.ChipLength = chipLength
+	d.Cfg.EnergyGate = gate
+	for _, name := range []string{"scm", "scm+", "idm", "r900"} {
+		p, err := protocol.NewParser(name, chipLength)
+		if err != nil {
+			b.Fatal(err)
+		}
+		d.RegisterProtocol(p)
+	}
+	d.Allocate()
+
+	rng := rand.New(rand.NewSource(1))
+	blocks := make([][]byte, 64)
+	for idx := range blocks {
+		blocks[idx] = make([]byte, d.Cfg.BlockSize2)
+		for sIdx := range blocks[idx] {
+			blocks[idx][sIdx] = byte(math.Round(127.5 + 8*rng.NormFloat64()))
+		}
+	}
+
+	b.SetBytes(int64(d.Cfg.BlockSize2))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for range d.Decode(blocks[n%len(blocks)]) {
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	benchmarkDecode(b, false)
+}
+
+func BenchmarkDecodeEnergyGate(b *testing.B) {
+	benchmarkDecode(b, true)
+}
@@ -0,0 +1,294 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"time"
+
+	"github.com/bemasher/rtlamr/protocol"
+	"github.com/bemasher/rtltcp"
+)
+
+// Initial delay between reconnection attempts, doubled after each failure.
+const minBackoff = time.Second
+
+// A Source provides a stream of interleaved IQ samples.
+type Source interface {
+	io.ReadCloser
+}
+
+// A Tuner is a Source whose center frequency, sample rate and gain can be
+// set. Sources which don't implement Tuner are used as-is.
+type Tuner interface {
+	SetCenterFreq(uint32) error
+	SetSampleRate(uint32) error
+	SetGainMode(bool) error
+}
+
+// A FreqCorrector is a Source whose frequency correction can be set in ppm,
+// such as rtl_tcp.
+type FreqCorrector interface {
+	SetFreqCorrection(uint32) error
+}
+
+// A Deadliner is a Source whose reads can time out, such as a network
+// connection.
+type Deadliner interface {
+	SetDeadline(time.Time) error
+}
+
+// Wraps a reader so only io.ReadCloser methods are exposed. Files have a
+// SetDeadline method which fails for regular files.
+type readerSource struct {
+	io.ReadCloser
+}
+
+// Opens the sample source selected by -source.
+func (rcvr *Receiver) OpenSource() (Source, error) {
+	switch *source {
+	case "rtltcp":
+		// Connect to rtl_tcp server.
+		if err := rcvr.Connect(); err != nil {
+			return nil, fmt.Errorf("rcvr.Connect: %w", err)
+		}
+		return &rcvr.SDR, nil
+	case "file":
+		f, err := os.Open(*inputFile)
+		if err != nil {
+			return nil, fmt.Errorf("os.Open: %w", err)
+		}
+		return readerSource{f}, nil
+	case "stdin":
+		return readerSource{io.NopCloser(os.Stdin)}, nil
+	case "tcp":
+		conn, err := net.Dial("tcp", rcvr.Flags.ServerAddr)
+		if err != nil {
+			return nil, fmt.Errorf("net.Dial: %w", err)
+		}
+		return conn, nil
+	}
+
+	return nil, fmt.Errorf("invalid source: %q", *source)
+}
+
+// A block of samples read from the source at center frequency freq, the last
+// of them at time t. If reset is set, the decoder should discard any state
+// left from previous blocks before decoding it.
+type sampleBlock struct {
+	samples []byte
+	reset   bool
+	freq    uint32
+	t       time.Time
+}
+
+// Reports whether a source is a network connection which can be re-established.
+func isNetworkSource(name string) bool {
+	return name == "rtltcp" || name == "tcp"
+}
+
+// Sets center frequency, sample rate and gain mode on sources which support
+// tuning. Sources such as files and pipes can't be tuned.
+func (rcvr *Receiver) Tune() error {
+	tuner, ok := rcvr.src.(Tuner)
+	if !ok {
+		return nil
+	}
+
+	if err := tuner.SetCenterFreq(uint32(int(rcvr.centerFreq) + *tuneOffset)); err != nil {
+		return fmt.Errorf("tuner.SetCenterFreq: %w", err)
+	}
+	sampleRate := rcvr.d.Cfg.SampleRate
+	if rcvr.capture != nil {
+		sampleRate = rcvr.capture.rate
+	}
+	if err := tuner.SetSampleRate(uint32(sampleRate)); err != nil {
+		return fmt.Errorf("tuner.SetSampleRate: %w", err)
+	}
+
+	if !rcvr.gainFlagSet {
+		if err := tuner.SetGainMode(true); err != nil {
+			return fmt.Errorf("tuner.SetGainMode: %w", err)
+		}
+	}
+
+	// A correction applied by calibration takes precedence over -freqcorrection.
+	if rcvr.corrected {
+		return rcvr.Correct(rcvr.correction)
+	}
+
+	return nil
+}
+
+// Tunes the source to a new center frequency, and again whenever the source
+// is reconnected. Called only by the goroutine reading samples.
+func (rcvr *Receiver) Retune(freq uint32) error {
+	rcvr.centerFreq = freq
+
+	tuner, ok := rcvr.src.(Tuner)
+	if !ok {
+		return fmt.Errorf("source %q does not support tuning", *source)
+	}
+
+	if err := tuner.SetCenterFreq(uint32(int(freq) + *tuneOffset)); err != nil {
+		return fmt.Errorf("tuner.SetCenterFreq: %w", err)
+	}
+
+	return nil
+}
+
+// Sets the source's frequency correction in ppm, and again whenever the source
+// is reconnected.
+func (rcvr *Receiver) Correct(ppm int) error {
+	corrector, ok := rcvr.src.(FreqCorrector)
+	if !ok {
+		return fmt.Errorf("source %q does not support frequency correction", *source)
+	}
+
+	rcvr.correction, rcvr.corrected = ppm, true
+	if err := corrector.SetFreqCorrection(uint32(ppm)); err != nil {
+		return fmt.Errorf("corrector.SetFreqCorrection: %w", err)
+	}
+
+	return nil
+}
+
+// Closes the source and reopens it, backing off exponentially between failed
+// attempts. Tuning and any rtl_tcp flags given are re-applied once connected.
+// Returns an error only if the receiver is stopped while reconnecting.
+func (rcvr *Receiver) Reconnect() error {
+	rcvr.src.Close()
+
+	backoff := minBackoff
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-rcvr.ctx.Done():
+			return context.Cause(rcvr.ctx)
+		case <-time.After(backoff):
+		}
+
+		src, err := rcvr.OpenSource()
+		if err == nil {
+			rcvr.src = src
+			if sdr, ok := src.(*rtltcp.SDR); ok {
+				err = sdr.HandleFlags()
+			}
+			if err == nil {
+				err = rcvr.Tune()
+			}
+			if err == nil {
+				rcvr.reconnects++
+				slog.Info("sample source reconnected", "name", rcvr.Name, "attempts", attempt, "count", rcvr.reconnects)
+				return nil
+			}
+			src.Close()
+		}
+
+		backoff = min(backoff<<1, *maxBackoff)
+		slog.Warn("sample source reconnect failed", "name", rcvr.Name, "error", err, "attempt", attempt, "retry", backoff)
+	}
+}
+
+// Reads a full sample block from the source.
+func readBlock(src Source, block []byte) (int, error) {
+	if d, ok := src.(Deadliner); ok {
+		err := d.SetDeadline(time.Now().Add(5 * time.Second))
+		if err != nil {
+			return 0, fmt.Errorf("src.SetDeadline: %w", err)
+		}
+	}
+
+	return io.ReadFull(src, block)
+}
+
+// A Capture reads samples from the source at a rate the decoder can't use
+// directly, such as the few a tuner supports, and resamples them to the
+// decoder's sample rate as interleaved cf32. Samples may also be low pass
+// filtered to a narrower band than the decoder's sample rate spans, and mixed
+// back to the center frequency from a tuner tuned away from it.
+type Capture struct {
+	rate  int
+	demod protocol.ComplexDemodulator
+	mixer *protocol.Mixer
+	r     *protocol.Resampler
+
+	raw []byte
+	iq  []complex64
+
+	// Resampled samples not yet read.
+	resampled []complex64
+}
+
+// Make a new capture of samples in format at rate, from a tuner tuned offset
+// Hz above the center frequency, resampled to the decoder's sample rate and
+// filtered to bandwidth Hz, zero for as wide as resampling allows.
+func NewCapture(format string, rate, offset int, bandwidth float64, cfg protocol.PacketConfig) (*Capture, error) {
+	demod, err := protocol.NewDemodulator(format)
+	if err != nil {
+		return nil, fmt.Errorf("protocol.NewDemodulator: %w", err)
+	}
+
+	// Samples are read a decoder's block at a time.
+	c := &Capture{
+		rate:  rate,
+		demod: demod.(protocol.ComplexDemodulator),
+		r:     protocol.NewResampler(rate, cfg.SampleRate, bandwidth/2),
+		raw:   make([]byte, cfg.BlockSize*demod.SampleSize()),
+		iq:    make([]complex64, cfg.BlockSize),
+	}
+	if offset != 0 {
+		c.mixer = protocol.NewMixer(float64(offset), rate)
+	}
+
+	return c, nil
+}
+
+// Discard samples buffered from before a reconnect or retune.
+func (c *Capture) Reset() {
+	c.r.Reset()
+	c.resampled = c.resampled[:0]
+}
+
+// Reads from the source until a full block of resampled samples is ready.
+func (c *Capture) ReadBlock(src Source, block []byte) (int, error) {
+	samples := len(block) >> 3
+	for len(c.resampled) < samples {
+		if _, err := readBlock(src, c.raw); err != nil {
+			return 0, err
+		}
+		c.demod.Complex(c.raw, c.iq)
+		if c.mixer != nil {
+			c.mixer.Mix(c.iq)
+		}
+		c.resampled = c.r.Resample(c.iq, c.resampled)
+	}
+
+	for idx, v := range c.resampled[:samples] {
+		binary.LittleEndian.PutUint32(block[idx<<3:], math.Float32bits(real(v)))
+		binary.LittleEndian.PutUint32(block[idx<<3+4:], math.Float32bits(imag(v)))
+	}
+	c.resampled = c.resampled[:copy(c.resampled, c.resampled[samples:])]
+
+	return len(block), nil
+}